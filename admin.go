@@ -0,0 +1,327 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// refresher wakes up the poll loop for an immediate re-resolution.
+// Requests are rate limited, so the external resolvers can't be hammered through it.
+type refresher struct {
+	minInterval time.Duration
+	trigger     chan struct{}
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newRefresher(minInterval time.Duration) *refresher {
+	return &refresher{
+		minInterval: minInterval,
+		trigger:     make(chan struct{}, 1),
+	}
+}
+
+// request asks for a refresh at now. If the last refresh was requested less than minInterval ago,
+// nothing happens and the time to wait until the next request is accepted is returned.
+func (r *refresher) request(now time.Time) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wait := r.last.Add(r.minInterval).Sub(now); !r.last.IsZero() && wait > 0 {
+		return false, wait
+	}
+
+	r.last = now
+	notify(r.trigger)
+
+	return true, 0
+}
+
+// httpServer serves an HTTP API of the provider.
+type httpServer struct {
+	server   *http.Server
+	listener net.Listener
+	log      *logger
+}
+
+func newHTTPServer(address string, handler http.Handler, log *logger) (*httpServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpServer{
+		server:   &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+		log:      log,
+	}, nil
+}
+
+func (s *httpServer) serve() {
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		s.log.Error("serving failed", "address", s.listener.Addr().String(), "error", err)
+	}
+}
+
+// shutdown waits a moment for active requests to finish and closes the remaining connections.
+func (s *httpServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Connections that were opened without sending a request yet only count as idle after a few seconds.
+	if err := s.server.Shutdown(ctx); err != nil {
+		return s.server.Close()
+	}
+
+	return nil
+}
+
+// validateAdminAddress checks that the admin API is either only reachable locally or requires token.
+func validateAdminAddress(address, token string) error {
+	if address == "" || token != "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("admin address: %w", err)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin address %q is not a loopback address, an admin token is required", address)
+	}
+
+	return nil
+}
+
+// adminHandler returns the handler of the local admin API.
+func (p *Provider) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", p.handleRefresh)
+	mux.HandleFunc("/grants", p.handleGrants)
+	mux.HandleFunc("/status", p.handleStatus)
+
+	handler := requireJSON(mux)
+
+	if p.adminToken == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requireJSON rejects requests that change something unless their content type is JSON.
+// Browsers only send such requests cross-origin after a CORS preflight, that the admin API never allows,
+// so a web page can't make the browser of an admin add grants or trigger refreshes.
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleRefresh triggers an immediate re-resolution of the public IPs.
+func (p *Provider) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ok, wait := p.refresh.request(p.clock.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// status is the state of the provider as reported by the admin API.
+type status struct {
+	Name        string               `json:"name"`
+	LastUpdate  time.Time            `json:"lastUpdate"`
+	IPv4        string               `json:"ipv4,omitempty"`
+	IPv6CIDR    string               `json:"ipv6CIDR,omitempty"`
+	CGNAT       bool                 `json:"cgnat,omitempty"`
+	WANs        map[string]wanStatus `json:"wans,omitempty"`
+	Middlewares map[string][]string  `json:"middlewares,omitempty"`
+	Grants      []grant              `json:"grants"`
+	History     []historyEntry       `json:"history,omitempty"`
+}
+
+// wanStatus is the state of a WAN as reported by the admin API.
+type wanStatus struct {
+	IPv4     string `json:"ipv4,omitempty"`
+	IPv6CIDR string `json:"ipv6CIDR,omitempty"`
+	wanHealth
+}
+
+// setStatus records the inputs and the source ranges of a newly generated configuration.
+func (p *Provider) setStatus(now time.Time, inputs generationInputs, configuration *dynamic.Configuration) {
+	st := status{
+		Name:        p.name,
+		LastUpdate:  now,
+		IPv4:        inputs.ipAddresses[defaultWAN].v4,
+		IPv6CIDR:    inputs.ipAddresses[defaultWAN].v6CIDR,
+		Middlewares: make(map[string][]string, len(p.whitelists)),
+		Grants:      append(make([]grant, 0, len(inputs.grants)), inputs.grants...),
+		History:     append([]historyEntry(nil), inputs.history...),
+	}
+
+	for _, wl := range p.whitelists {
+		if sourceRange, ok := whitelistSourceRange(configuration, wl.name); ok {
+			st.Middlewares[wl.name] = copyStrings(sourceRange)
+		}
+	}
+
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+
+	for _, w := range p.wans {
+		health := p.wanHealth[w.name]
+		st.CGNAT = st.CGNAT || health.CGNAT
+
+		if w.name == defaultWAN {
+			continue
+		}
+
+		if st.WANs == nil {
+			st.WANs = make(map[string]wanStatus, len(p.wans))
+		}
+
+		st.WANs[w.name] = wanStatus{
+			IPv4:      inputs.ipAddresses[w.name].v4,
+			IPv6CIDR:  inputs.ipAddresses[w.name].v6CIDR,
+			wanHealth: health,
+		}
+	}
+
+	p.status = st
+}
+
+// handleStatus reports the state of the provider.
+func (p *Provider) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.statusMu.Lock()
+	st := p.status
+	p.statusMu.Unlock()
+
+	p.writeJSON(w, http.StatusOK, st)
+}
+
+// grantRequest is the body of a request adding a grant.
+type grantRequest struct {
+	SourceRange string `json:"sourceRange"`
+	Middleware  string `json:"middleware,omitempty"`
+	Duration    string `json:"duration"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// handleGrants lists, adds and removes temporary grants.
+func (p *Provider) handleGrants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p.writeJSON(w, http.StatusOK, p.grants.active(p.clock.Now()))
+
+	case http.MethodPost:
+		var req grantRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", req.Duration), http.StatusBadRequest)
+			return
+		}
+
+		g := grant{
+			SourceRange: req.SourceRange,
+			Middleware:  req.Middleware,
+			Expires:     p.clock.Now().Add(duration),
+			Comment:     req.Comment,
+			Origin:      grantOriginAPI,
+		}
+
+		if err = g.validate(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p.grants.add(g)
+		notify(p.regenerate)
+
+		p.log.Info("grant added", "middleware", g.Middleware, "sourceRange", g.SourceRange, "expires", g.Expires, "origin", g.Origin)
+
+		p.writeJSON(w, http.StatusCreated, g)
+
+	case http.MethodDelete:
+		middleware := r.URL.Query().Get("middleware")
+		if middleware == "" {
+			middleware = whitelistMiddleware
+		}
+
+		sourceRange := r.URL.Query().Get("sourceRange")
+
+		if p.grants.remove(sourceRange, middleware) == 0 {
+			http.Error(w, "no such grant", http.StatusNotFound)
+			return
+		}
+
+		notify(p.regenerate)
+
+		p.log.Info("grant removed", "middleware", middleware, "sourceRange", sourceRange)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Provider) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	// Mostly the client went away, which is no concern of the provider.
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.log.Debug("writing response failed", "error", err)
+	}
+}
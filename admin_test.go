@@ -0,0 +1,187 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateAdminAddress(t *testing.T) {
+	for _, address := range []string{"", "127.0.0.1:8089", "[::1]:8089", "localhost:8089"} {
+		if err := validateAdminAddress(address, ""); err != nil {
+			t.Errorf("%s: %v", address, err)
+		}
+	}
+
+	for _, address := range []string{":8089", "0.0.0.0:8089", "192.0.2.1:8089", "admin.example.com:8089"} {
+		if err := validateAdminAddress(address, ""); err == nil {
+			t.Errorf("%s: expected an error without a token", address)
+		}
+
+		if err := validateAdminAddress(address, "a-long-random-admin-token"); err != nil {
+			t.Errorf("%s with a token: %v", address, err)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	config := testConfig()
+	config.AdminAddress = ":0"
+	config.AdminToken = "a-long-random-admin-token"
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := p.adminHandler()
+
+	for token, expected := range map[string]int{
+		"":                          http.StatusUnauthorized,
+		"wrong":                     http.StatusUnauthorized,
+		"a-long-random-admin-token": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("token %q: got status %d, want %d", token, rec.Code, expected)
+		}
+	}
+}
+
+func TestGrantLimits(t *testing.T) {
+	config := testConfig()
+	config.AdminAddress = "127.0.0.1:0"
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sourceRange, expected := range map[string]int{
+		"0.0.0.0/0":       http.StatusBadRequest,
+		"::/0":            http.StatusBadRequest,
+		"198.51.0.0/16":   http.StatusBadRequest,
+		"2001:db8::/32":   http.StatusBadRequest,
+		"198.51.100.0/24": http.StatusCreated,
+		"2001:db8::/48":   http.StatusCreated,
+		"203.0.113.7":     http.StatusCreated,
+	} {
+		body := `{"sourceRange": "` + sourceRange + `", "duration": "1h"}`
+		req := httptest.NewRequest(http.MethodPost, "/grants", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		p.adminHandler().ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("%s: got status %d, want %d", sourceRange, rec.Code, expected)
+		}
+	}
+
+	if _, err = newGrantLimits(33, 48); err == nil {
+		t.Error("expected an error for an IPv4 prefix length beyond 32")
+	}
+}
+
+func TestAdminRequiresJSON(t *testing.T) {
+	config := testConfig()
+	config.AdminAddress = "127.0.0.1:0"
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := p.adminHandler()
+
+	// A web page can send these without a CORS preflight, with the content type of a form or none.
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data"} {
+		for _, target := range []string{"/grants", "/refresh"} {
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"sourceRange": "203.0.113.7", "duration": "1h"}`))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("POST %s as %q: got status %d, want %d", target, contentType, rec.Code, http.StatusUnsupportedMediaType)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/grants?sourceRange=203.0.113.7", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("DELETE: got status %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+
+	if grants := p.grants.active(p.clock.Now()); len(grants) != 0 {
+		t.Errorf("unexpected grants %+v", grants)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("POST /refresh as JSON: got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+}
+
+func TestAdminIsClosedWhenSelfServiceFails(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminAddress := free.Addr().String()
+	free.Close()
+
+	config := testConfig()
+	config.AdminAddress = adminAddress
+	config.SelfService = &SelfServiceConfig{
+		Address:  occupied.Addr().String(),
+		Tokens:   []string{"correct-horse-battery-staple"},
+		Duration: "2h",
+	}
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Provide(make(chan json.Marshaler)); err == nil {
+		t.Fatal("expected an error for the occupied self-service address")
+	}
+
+	// Traefik doesn't call Stop after Provide failed, so the admin API must not keep its address.
+	listener, err := net.Listen("tcp", adminAddress)
+	if err != nil {
+		t.Fatalf("the admin API still listens: %v", err)
+	}
+
+	listener.Close()
+}
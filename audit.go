@@ -0,0 +1,326 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// Causes of a change of a whitelist in the audit log.
+const (
+	auditCauseStart       = "start"
+	auditCauseResolver    = "resolver"
+	auditCauseGrant       = "grant"
+	auditCauseGrantExpiry = "grant expiry"
+	auditCauseFileReload  = "file reload"
+	auditCauseSchedule    = "schedule"
+	auditCauseHistory     = "history"
+	auditCauseGeoIP       = "geoip"
+)
+
+// auditRecord is a line of the audit log: a change of the source range of a whitelist middleware.
+type auditRecord struct {
+	Time        time.Time       `json:"time"`
+	Provider    string          `json:"provider"`
+	Middleware  string          `json:"middleware"`
+	Added       []string        `json:"added"`
+	Removed     []string        `json:"removed"`
+	Causes      []string        `json:"causes"`
+	Resolvers   []auditIPChange `json:"resolvers,omitempty"`
+	SourceRange []string        `json:"sourceRange"`
+}
+
+// auditIPChange is a change of a public IP, with the resolver that returned it.
+type auditIPChange struct {
+	WAN      string `json:"wan,omitempty"`
+	Family   string `json:"family"`
+	Resolver string `json:"resolver,omitempty"`
+	Address  string `json:"address"`
+	Previous string `json:"previous"`
+}
+
+// auditInputs are the inputs of the source range of a whitelist, that are compared to find the causes of a change.
+type auditInputs struct {
+	sourceRange []string
+	grants      map[string]grant // By origin and source range.
+	scheduled   []string
+	history     []string
+	countries   []string
+}
+
+// auditLog appends every effective change of the whitelists to a JSONL file.
+// The file is rotated when it would grow beyond maxSize, keeping maxBackups rotated files as file.1, file.2, ...
+type auditLog struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+
+	// Only used by the goroutine publishing the configurations.
+	last            map[string]auditInputs
+	lastIPAddresses wanAddresses
+}
+
+func newAuditLog(file string, maxSize int64, maxBackups int) (*auditLog, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	if maxSize < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("audit log size and backups must not be negative")
+	}
+
+	// Rotating without backups would delete the audit trail.
+	if maxSize > 0 && maxBackups == 0 {
+		return nil, fmt.Errorf("audit log rotation needs at least one backup, set the size to 0 to disable rotation")
+	}
+
+	return &auditLog{file: file, maxSize: maxSize, maxBackups: maxBackups}, nil
+}
+
+// audit records the changes of the whitelists of a configuration Traefik received.
+func (p *Provider) audit(inputs generationInputs, configuration *dynamic.Configuration) {
+	a := p.auditLog
+	if a == nil {
+		return
+	}
+
+	ipChanges := p.ipChanges(a.lastIPAddresses, inputs.ipAddresses)
+	current := make(map[string]auditInputs, len(p.whitelists))
+
+	for _, wl := range p.whitelists {
+		last, known := a.last[wl.name]
+
+		// A whitelist that was left out hasn't changed as far as Traefik is concerned.
+		sourceRange, ok := whitelistSourceRange(configuration, wl.name)
+		if !ok {
+			if known {
+				current[wl.name] = last
+			}
+
+			continue
+		}
+
+		in := auditInputs{
+			sourceRange: sourceRange,
+			grants:      map[string]grant{},
+			scheduled:   scheduledSourceRanges(p.schedules, wl.name, inputs.now),
+			history:     historySourceRanges(inputs.history, p.whitelistIPv4, p.whitelistIPv6),
+			countries:   countrySourceRanges(inputs.countries, wl.countries),
+		}
+
+		for _, g := range inputs.grants {
+			if g.Middleware == wl.name {
+				in.grants[g.Origin+" "+g.SourceRange] = g
+			}
+		}
+
+		current[wl.name] = in
+
+		added, removed := diffSourceRanges(last.sourceRange, in.sourceRange)
+		if known && len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		record := auditRecord{
+			Time:        inputs.now,
+			Provider:    p.name,
+			Middleware:  wl.name,
+			Added:       added,
+			Removed:     removed,
+			SourceRange: in.sourceRange,
+		}
+
+		if !known {
+			record.Causes = []string{auditCauseStart}
+		} else {
+			record.Causes = auditCauses(last, in, inputs.now, len(ipChanges) > 0)
+		}
+
+		if known && len(ipChanges) > 0 {
+			record.Resolvers = ipChanges
+		}
+
+		if err := a.write(record); err != nil {
+			p.log.with("middleware", wl.name).Error("writing audit log failed", "file", a.file, "error", err)
+		}
+	}
+
+	a.last = current
+	a.lastIPAddresses = inputs.ipAddresses
+}
+
+// ipChanges returns the changes of the public IPs of the WANs, with the resolvers that returned them.
+func (p *Provider) ipChanges(last, current wanAddresses) []auditIPChange {
+	var changes []auditIPChange
+
+	for _, w := range p.wans {
+		before, after := last[w.name], current[w.name]
+
+		if before.v4 != after.v4 {
+			changes = append(changes, auditIPChange{
+				WAN: w.name, Family: "IPv4", Resolver: describeResolver(w.ipv4Resolver), Address: after.v4, Previous: before.v4,
+			})
+		}
+
+		if before.v6CIDR != after.v6CIDR {
+			changes = append(changes, auditIPChange{
+				WAN: w.name, Family: "IPv6", Resolver: describeResolver(w.ipv6Resolver), Address: after.v6CIDR, Previous: before.v6CIDR,
+			})
+		}
+	}
+
+	return changes
+}
+
+// describeResolver returns the URL of a resolver, or an empty string if it has none.
+func describeResolver(r resolver) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return ""
+}
+
+// auditCauses returns which inputs of a whitelist changed between last and current.
+func auditCauses(last, current auditInputs, now time.Time, ipChanged bool) []string {
+	causes := map[string]bool{}
+
+	if ipChanged {
+		causes[auditCauseResolver] = true
+	}
+
+	for key, g := range last.grants {
+		if _, ok := current.grants[key]; ok {
+			continue
+		}
+
+		switch {
+		case !g.Expires.After(now):
+			causes[auditCauseGrantExpiry] = true
+		case g.Origin == grantOriginFile:
+			causes[auditCauseFileReload] = true
+		default:
+			causes[auditCauseGrant] = true
+		}
+	}
+
+	for key, g := range current.grants {
+		if _, ok := last.grants[key]; ok {
+			continue
+		}
+
+		if g.Origin == grantOriginFile {
+			causes[auditCauseFileReload] = true
+		} else {
+			causes[auditCauseGrant] = true
+		}
+	}
+
+	if added, removed := diffSourceRanges(last.scheduled, current.scheduled); len(added)+len(removed) > 0 {
+		causes[auditCauseSchedule] = true
+	}
+
+	if added, removed := diffSourceRanges(last.history, current.history); len(added)+len(removed) > 0 {
+		causes[auditCauseHistory] = true
+	}
+
+	if added, removed := diffSourceRanges(last.countries, current.countries); len(added)+len(removed) > 0 {
+		causes[auditCauseGeoIP] = true
+	}
+
+	result := make([]string, 0, len(causes))
+	for cause := range causes {
+		result = append(result, cause)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// diffSourceRanges returns the entries of current missing in last, and the entries of last missing in current.
+func diffSourceRanges(last, current []string) ([]string, []string) {
+	lastSet := make(map[string]bool, len(last))
+	for _, entry := range last {
+		lastSet[entry] = true
+	}
+
+	currentSet := make(map[string]bool, len(current))
+	for _, entry := range current {
+		currentSet[entry] = true
+	}
+
+	added, removed := []string{}, []string{}
+
+	for _, entry := range current {
+		if !lastSet[entry] {
+			added = append(added, entry)
+		}
+	}
+
+	for _, entry := range last {
+		if !currentSet[entry] {
+			removed = append(removed, entry)
+		}
+	}
+
+	return added, removed
+}
+
+// write appends record to the audit log, rotating it first if it would grow too large.
+func (a *auditLog) write(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if err = a.rotate(int64(len(line))); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// rotate moves the audit log to file.1, and the older files one number up, if size more bytes would exceed maxSize.
+// A log without maxSize isn't rotated.
+func (a *auditLog) rotate(size int64) error {
+	if a.maxSize <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 || info.Size()+size <= a.maxSize {
+		return nil
+	}
+
+	for i := a.maxBackups - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", a.file, i), fmt.Sprintf("%s.%d", a.file, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(a.file, a.file+".1")
+}
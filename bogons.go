@@ -0,0 +1,97 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"fmt"
+	"net"
+)
+
+// Policies for a resolver response that can't be a public IP.
+const (
+	// bogonPolicyReject treats the response as a failed resolution.
+	bogonPolicyReject = "reject"
+	// bogonPolicyWarn logs a warning and whitelists the address anyway.
+	bogonPolicyWarn = "warn"
+	// bogonPolicyAllow whitelists the address silently.
+	bogonPolicyAllow = "allow"
+)
+
+// bogonCGNAT is the class of the shared address space of carrier-grade NAT.
+const bogonCGNAT = "CGNAT"
+
+// bogon a network that never contains the public IP of a host.
+type bogon struct {
+	network *net.IPNet
+	class   string
+}
+
+var bogons = parseBogons(map[string]string{
+	"0.0.0.0/8":       "this network",
+	"10.0.0.0/8":      "private",
+	"100.64.0.0/10":   bogonCGNAT,
+	"127.0.0.0/8":     "loopback",
+	"169.254.0.0/16":  "link-local",
+	"172.16.0.0/12":   "private",
+	"192.0.0.0/24":    "IETF protocol assignment",
+	"192.0.2.0/24":    "documentation",
+	"192.168.0.0/16":  "private",
+	"198.18.0.0/15":   "benchmarking",
+	"198.51.100.0/24": "documentation",
+	"203.0.113.0/24":  "documentation",
+	"224.0.0.0/4":     "multicast",
+	"240.0.0.0/4":     "reserved",
+	"::/127":          "unspecified or loopback",
+	"100::/64":        "discard-only",
+	"2001:db8::/32":   "documentation",
+	"3fff::/20":       "documentation",
+	"fc00::/7":        "unique local",
+	"fe80::/10":       "link-local",
+	"ff00::/8":        "multicast",
+})
+
+func parseBogons(networks map[string]string) []bogon {
+	result := make([]bogon, 0, len(networks))
+
+	for cidr, class := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		result = append(result, bogon{network: network, class: class})
+	}
+
+	return result
+}
+
+// classifyBogon returns the class of the bogon network ip belongs to, or false if it may be a public IP.
+func classifyBogon(ip net.IP) (string, bool) {
+	for _, b := range bogons {
+		if b.network.Contains(ip) {
+			return b.class, true
+		}
+	}
+
+	return "", false
+}
+
+// checkPublicIP applies the bogon policy to an address returned by a resolver.
+func (p *Provider) checkPublicIP(ip net.IP) error {
+	class, isBogon := classifyBogon(ip)
+	if !isBogon {
+		return nil
+	}
+
+	message := fmt.Sprintf("resolver returned the %s address %s", class, ip)
+	if class == bogonCGNAT {
+		message += ", the host is behind carrier-grade NAT and shares its public IP, so the whitelist can't work as intended"
+	}
+
+	switch p.bogonPolicy {
+	case bogonPolicyReject:
+		return fmt.Errorf("%s", message)
+	case bogonPolicyWarn:
+		p.log.Warn(message+", whitelisting it anyway", "address", ip.String(), "class", class)
+	}
+
+	return nil
+}
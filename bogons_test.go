@@ -0,0 +1,88 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyBogon(t *testing.T) {
+	testCases := map[string]string{
+		"10.1.2.3":        "private",
+		"172.31.255.255":  "private",
+		"192.168.0.1":     "private",
+		"100.64.0.1":      bogonCGNAT,
+		"100.127.255.1":   bogonCGNAT,
+		"127.0.0.1":       "loopback",
+		"169.254.1.1":     "link-local",
+		"203.0.113.9":     "documentation",
+		"239.1.1.1":       "multicast",
+		"255.255.255.255": "reserved",
+		"::1":             "unspecified or loopback",
+		"fd00::1":         "unique local",
+		"fe80::1":         "link-local",
+		"2001:db8::1":     "documentation",
+		"ff02::1":         "multicast",
+		"1.1.1.1":         "",
+		"100.128.0.1":     "",
+		"172.32.0.1":      "",
+		"2606:4700::1":    "",
+	}
+
+	for address, expected := range testCases {
+		class, isBogon := classifyBogon(net.ParseIP(address))
+		if class != expected || isBogon != (expected != "") {
+			t.Errorf("%s: got %q, %t, want %q", address, class, isBogon, expected)
+		}
+	}
+}
+
+func TestBogonPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		ip       string
+		expected []string
+		cgnat    bool
+	}{
+		{policy: bogonPolicyReject, ip: "10.0.0.1", expected: nil},
+		{policy: bogonPolicyReject, ip: "100.64.0.1", expected: nil, cgnat: true},
+		{policy: bogonPolicyReject, ip: "1.1.1.1", expected: []string{"1.1.1.1/32"}},
+		{policy: bogonPolicyWarn, ip: "100.64.0.1", expected: []string{"100.64.0.1/32"}, cgnat: true},
+		{policy: bogonPolicyAllow, ip: "10.0.0.1", expected: []string{"10.0.0.1/32"}},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.policy+" "+test.ip, func(t *testing.T) {
+			config := CreateConfig()
+			config.BogonPolicy = test.policy
+
+			ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: test.ip}}}
+
+			p, cfgChan := startProvider(t, config, withClock(newFakeClock()), withResolvers(ipv4, ipv4))
+
+			if got := nextSourceRange(t, cfgChan); len(got)+len(test.expected) > 0 && !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got %v, want %v", got, test.expected)
+			}
+
+			p.statusMu.Lock()
+			cgnat := p.status.CGNAT
+			p.statusMu.Unlock()
+
+			if cgnat != test.cgnat {
+				t.Errorf("got CGNAT %t, want %t", cgnat, test.cgnat)
+			}
+		})
+	}
+}
+
+func TestInvalidBogonPolicy(t *testing.T) {
+	config := CreateConfig()
+	config.BogonPolicy = "ignore"
+
+	if _, err := newProvider(context.Background(), config, "test"); err == nil {
+		t.Fatal("expected an error for an invalid bogon policy")
+	}
+}
@@ -0,0 +1,218 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// ChainConfig the middlewares that are chained after the whitelist.
+// A single reference to the chain applies the whitelist and all of them.
+// With AuthFallback, generated routes accept whitelisted IPs without authentication and everyone else with it.
+type ChainConfig struct {
+	Name         string               `json:"name,omitempty"`
+	RateLimit    *dynamic.RateLimit   `json:"rateLimit,omitempty"`
+	BasicAuth    *dynamic.BasicAuth   `json:"basicAuth,omitempty"`
+	ForwardAuth  *dynamic.ForwardAuth `json:"forwardAuth,omitempty"`
+	Headers      *dynamic.Headers     `json:"headers,omitempty"`
+	AuthFallback bool                 `json:"authFallback,omitempty"`
+}
+
+// defaultChainName is the name of the generated chain, if none is configured.
+const defaultChainName = "public_protected"
+
+func newChain(config *ChainConfig) (*ChainConfig, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	chain := &ChainConfig{}
+	if err := cloneJSON(config, chain); err != nil {
+		return nil, fmt.Errorf("chain: %w", err)
+	}
+
+	if chain.Name == "" {
+		chain.Name = defaultChainName
+	}
+
+	if chain.Name == whitelistMiddleware {
+		return nil, fmt.Errorf("chain: name %q is reserved for the whitelist", chain.Name)
+	}
+
+	if chain.RateLimit == nil && chain.BasicAuth == nil && chain.ForwardAuth == nil && chain.Headers == nil {
+		return nil, fmt.Errorf("chain: at least one of rateLimit, basicAuth, forwardAuth or headers is required")
+	}
+
+	if chain.AuthFallback && chain.BasicAuth == nil && chain.ForwardAuth == nil {
+		return nil, fmt.Errorf("chain: authFallback requires basicAuth or forwardAuth")
+	}
+
+	return chain, nil
+}
+
+// validateChain checks that the middlewares of chain don't collide with the whitelists in middlewares,
+// which holds the names of all middlewares a route may use and gets the chain added.
+func validateChain(chain *ChainConfig, middlewares map[string]bool, config *Config) error {
+	if chain == nil {
+		return nil
+	}
+
+	names, err := chain.middlewareNames()
+	if err != nil {
+		return fmt.Errorf("chain: %w", err)
+	}
+
+	for _, name := range names {
+		if middlewares[name] {
+			return fmt.Errorf("chain: name %q is already used by a whitelist", name)
+		}
+	}
+
+	middlewares[chain.Name] = true
+
+	if !chain.AuthFallback {
+		return nil
+	}
+
+	// ClientIP matches the address of the connection, not an address of X-Forwarded-For like the whitelist does.
+	if config.IPStrategy.Depth > 0 || len(config.IPStrategy.ExcludedIPs) > 0 {
+		return fmt.Errorf("chain: authFallback matches the IP of the connection and can't be combined with ipStrategy")
+	}
+
+	// Every whitelisted network becomes a ClientIP matcher, the networks of a country would make a rule of thousands.
+	if len(config.Countries) > 0 {
+		return fmt.Errorf("chain: authFallback matches every whitelisted network in a router rule and can't be combined with countries")
+	}
+
+	return validateFallbackRoutes(config.Routes)
+}
+
+// chainPart is a middleware of the chain after the whitelist.
+type chainPart struct {
+	name       string
+	auth       bool // Whether the part authenticates, these are skipped for whitelisted IPs with AuthFallback.
+	middleware *dynamic.Middleware
+}
+
+// parts returns the chained middlewares in order. Every one is named after the chain, e.g. public_protected-ratelimit.
+// The middlewares are cloned, so the generated configuration shares no memory with the provider settings.
+func (c *ChainConfig) parts() ([]chainPart, error) {
+	var parts []chainPart
+
+	if c.RateLimit != nil {
+		rateLimit := &dynamic.RateLimit{}
+		if err := cloneJSON(c.RateLimit, rateLimit); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, chainPart{name: c.Name + "-ratelimit", middleware: &dynamic.Middleware{RateLimit: rateLimit}})
+	}
+
+	if c.BasicAuth != nil {
+		basicAuth := &dynamic.BasicAuth{}
+		if err := cloneJSON(c.BasicAuth, basicAuth); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, chainPart{name: c.Name + "-basicauth", auth: true, middleware: &dynamic.Middleware{BasicAuth: basicAuth}})
+	}
+
+	if c.ForwardAuth != nil {
+		forwardAuth := &dynamic.ForwardAuth{}
+		if err := cloneJSON(c.ForwardAuth, forwardAuth); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, chainPart{name: c.Name + "-forwardauth", auth: true, middleware: &dynamic.Middleware{ForwardAuth: forwardAuth}})
+	}
+
+	if c.Headers != nil {
+		headers := &dynamic.Headers{}
+		if err := cloneJSON(c.Headers, headers); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, chainPart{name: c.Name + "-headers", middleware: &dynamic.Middleware{Headers: headers}})
+	}
+
+	return parts, nil
+}
+
+// middlewareNames returns the names of all middlewares generated for the chain.
+func (c *ChainConfig) middlewareNames() ([]string, error) {
+	parts, err := c.parts()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{c.Name}
+	for _, part := range parts {
+		names = append(names, part.name)
+	}
+
+	if c.AuthFallback {
+		names = append(names, c.whitelistedName(), c.authenticatedName())
+	}
+
+	return names, nil
+}
+
+// whitelistedName is the name of the chain of whitelisted requests with AuthFallback: the chain without authentication.
+func (c *ChainConfig) whitelistedName() string {
+	return c.Name + "-whitelisted"
+}
+
+// authenticatedName is the name of the chain of all other requests with AuthFallback: the chain without the whitelist.
+func (c *ChainConfig) authenticatedName() string {
+	return c.Name + "-authenticated"
+}
+
+// addChain adds the chained middlewares and the chain itself to configuration and returns the name of the chain.
+// With AuthFallback, it adds the chains of the two routers of every generated route as well.
+func addChain(configuration *dynamic.Configuration, chain *ChainConfig, whitelist string) (string, error) {
+	parts, err := chain.parts()
+	if err != nil {
+		return "", err
+	}
+
+	middlewares := []string{whitelist}
+	whitelisted := []string{whitelist}
+
+	var authenticated []string
+
+	for _, part := range parts {
+		configuration.HTTP.Middlewares[part.name] = part.middleware
+		middlewares = append(middlewares, part.name)
+		authenticated = append(authenticated, part.name)
+
+		if !part.auth {
+			whitelisted = append(whitelisted, part.name)
+		}
+	}
+
+	configuration.HTTP.Middlewares[chain.Name] = &dynamic.Middleware{
+		Chain: &dynamic.Chain{Middlewares: middlewares},
+	}
+
+	if chain.AuthFallback {
+		configuration.HTTP.Middlewares[chain.whitelistedName()] = &dynamic.Middleware{
+			Chain: &dynamic.Chain{Middlewares: whitelisted},
+		}
+		configuration.HTTP.Middlewares[chain.authenticatedName()] = &dynamic.Middleware{
+			Chain: &dynamic.Chain{Middlewares: authenticated},
+		}
+	}
+
+	return chain.Name, nil
+}
+
+// cloneJSON deep copies src into dst through their JSON representation.
+func cloneJSON(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, dst)
+}
@@ -0,0 +1,54 @@
+package traefik_dynamic_public_whitelist
+
+import "time"
+
+// clock is the source of time of the provider, tests replace it to control the poll loop.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	NewTimer(d time.Duration) timer
+}
+
+// ticker is the part of time.Ticker used by the provider.
+type ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// timer is the part of time.Timer used by the provider.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shoggomo/traefik_dynamic_public_whitelist"
+)
+
+// consulMaxTxnOps is the limit of operations of a Consul transaction.
+const consulMaxTxnOps = 64
+
+// consulStore is the KV store of a Consul agent.
+type consulStore struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// newConsulStore returns the store of the agent at a URL like http://127.0.0.1:8500, using the ACL token if it is set.
+func newConsulStore(rawURL, token string) (*consulStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported Consul URL scheme %q, use http or https", u.Scheme)
+	}
+
+	return &consulStore{
+		endpoint: strings.TrimSuffix(u.String(), "/"),
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// checkConsulConfig returns an error for a configuration with countries, their networks don't fit into
+// a transaction of consulMaxTxnOps operations. Unlike etcd's, the limit can't be raised.
+func checkConsulConfig(config *traefik_dynamic_public_whitelist.Config) error {
+	if len(config.Countries) > 0 {
+		return fmt.Errorf("countries can't be published to Consul, their networks exceed its transaction limit of %d operations", consulMaxTxnOps)
+	}
+
+	for name, wl := range config.Whitelists {
+		if len(wl.Countries) > 0 {
+			return fmt.Errorf("countries of whitelist %s can't be published to Consul, their networks exceed its transaction limit of %d operations",
+				name, consulMaxTxnOps)
+		}
+	}
+
+	return nil
+}
+
+func (s *consulStore) String() string {
+	return s.endpoint
+}
+
+// list requests the keys below every prefix.
+func (s *consulStore) list(prefixes []string) ([]string, error) {
+	var keys []string
+
+	for _, prefix := range prefixes {
+		var found []string
+
+		status, err := s.request(http.MethodGet, "/v1/kv/"+escapeKey(prefix)+"?keys", nil, &found)
+		if err != nil && status != http.StatusNotFound {
+			return nil, err
+		}
+
+		keys = append(keys, found...)
+	}
+
+	return keys, nil
+}
+
+// update sets and deletes the keys in one transaction of at most consulMaxTxnOps operations.
+func (s *consulStore) update(entries map[string]string, remove []string) error {
+	if len(entries) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	operations, err := kvOperations("Consul", entries, remove, consulMaxTxnOps)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]interface{}, 0, len(operations))
+
+	for _, op := range operations {
+		kv := map[string]interface{}{"Verb": "set", "Key": op.key, "Value": []byte(op.value)}
+		if op.remove {
+			kv = map[string]interface{}{"Verb": "delete", "Key": op.key}
+		}
+
+		ops = append(ops, map[string]interface{}{"KV": kv})
+	}
+
+	_, err = s.request(http.MethodPut, "/v1/txn", ops, nil)
+
+	return err
+}
+
+// request sends body as JSON and decodes the response into response, unless it is nil.
+// It returns the status code of the response, which is 404 for a list without keys.
+func (s *consulStore) request(method, path string, body, response interface{}) (int, error) {
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.endpoint+path, reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, kvResponseError(resp.Status, data)
+	}
+
+	if response == nil {
+		return resp.StatusCode, nil
+	}
+
+	return resp.StatusCode, json.Unmarshal(data, response)
+}
+
+// escapeKey escapes the segments of a key for the path of a URL.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The encoders work on the generic JSON form of the configuration, so they use the same keys as the plugin.
+// Traefik's file provider reads YAML and TOML with these keys.
+
+// decodeJSON decodes data into generic maps, slices and scalars, keeping numbers as they are.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// quote returns s as double-quoted string, that is valid in YAML and TOML.
+func quote(s string) string {
+	var b bytes.Buffer
+
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+var (
+	yamlPlainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+	tomlBareKey  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// yamlReserved are the plain words YAML parsers read as booleans or null.
+var yamlReserved = map[string]bool{
+	"y": true, "n": true, "yes": true, "no": true, "on": true, "off": true, "true": true, "false": true, "null": true,
+}
+
+func yamlKey(k string) string {
+	if yamlPlainKey.MatchString(k) && !yamlReserved[strings.ToLower(k)] {
+		return k
+	}
+
+	return quote(k)
+}
+
+// encodeYAML encodes a generic value as YAML document.
+func encodeYAML(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("YAML document must be a map, got %T", v)
+	}
+
+	if err := writeYAMLMap(&b, m, 0); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func writeYAMLMap(b *bytes.Buffer, m map[string]interface{}, indent int) error {
+	for _, k := range sortedKeys(m) {
+		b.WriteString(strings.Repeat(" ", indent))
+		b.WriteString(yamlKey(k))
+		b.WriteString(":")
+
+		if err := writeYAMLValue(b, m[k], indent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeYAMLValue writes the value of a key or list item, starting on the line of the key or dash.
+func writeYAMLValue(b *bytes.Buffer, v interface{}, indent int) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(" {}\n")
+			return nil
+		}
+
+		b.WriteString("\n")
+
+		return writeYAMLMap(b, v, indent+2)
+
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(" []\n")
+			return nil
+		}
+
+		b.WriteString("\n")
+
+		for _, item := range v {
+			if err := writeYAMLItem(b, item, indent+2); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default:
+		scalar, err := yamlScalar(v)
+		if err != nil {
+			return err
+		}
+
+		b.WriteString(" " + scalar + "\n")
+
+		return nil
+	}
+}
+
+// writeYAMLItem writes a list item. Maps and lists start on the line of the dash.
+func writeYAMLItem(b *bytes.Buffer, v interface{}, indent int) error {
+	switch v := v.(type) {
+	case map[string]interface{}, []interface{}:
+		var item bytes.Buffer
+
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			if err := writeYAMLMap(&item, m, indent+2); err != nil {
+				return err
+			}
+		} else if l, ok := v.([]interface{}); ok && len(l) > 0 {
+			for _, nested := range l {
+				if err := writeYAMLItem(&item, nested, indent+2); err != nil {
+					return err
+				}
+			}
+		} else {
+			b.WriteString(strings.Repeat(" ", indent) + "-")
+			return writeYAMLValue(b, v, indent)
+		}
+
+		// The dash takes the place of the indentation of the first line.
+		b.WriteString(strings.Repeat(" ", indent) + "- ")
+		b.Write(item.Bytes()[indent+2:])
+
+		return nil
+
+	default:
+		scalar, err := yamlScalar(v)
+		if err != nil {
+			return err
+		}
+
+		b.WriteString(strings.Repeat(" ", indent) + "- " + scalar + "\n")
+
+		return nil
+	}
+}
+
+func yamlScalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "null", nil
+	case string:
+		return quote(v), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported value %T", v)
+	}
+}
+
+func tomlKey(k string) string {
+	if tomlBareKey.MatchString(k) {
+		return k
+	}
+
+	return quote(k)
+}
+
+// encodeTOML encodes a generic value as TOML document.
+// Maps become tables and lists of maps arrays of tables, everything else is written inline.
+// TOML has no null, so keys without a value are left out.
+func encodeTOML(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("TOML document must be a map, got %T", v)
+	}
+
+	if err := writeTOMLTable(&b, m, nil, false); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimLeft(b.Bytes(), "\n"), nil
+}
+
+// writeTOMLTable writes the table at path. The header is left out if the table only contains tables,
+// unless it is an element of an array of tables.
+func writeTOMLTable(b *bytes.Buffer, m map[string]interface{}, path []string, arrayElement bool) error {
+	var inline, tables, arrays []string
+
+	for _, k := range sortedKeys(m) {
+		switch v := m[k].(type) {
+		case nil:
+		case map[string]interface{}:
+			if len(v) == 0 {
+				inline = append(inline, k)
+			} else {
+				tables = append(tables, k)
+			}
+		case []interface{}:
+			if isTableArray(v) {
+				arrays = append(arrays, k)
+			} else {
+				inline = append(inline, k)
+			}
+		default:
+			inline = append(inline, k)
+		}
+	}
+
+	if len(path) > 0 && (arrayElement || len(inline) > 0) {
+		open, closing := "[", "]"
+		if arrayElement {
+			open, closing = "[[", "]]"
+		}
+
+		b.WriteString("\n" + open + tomlPath(path) + closing + "\n")
+	}
+
+	for _, k := range inline {
+		value, err := tomlInline(m[k])
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+
+		b.WriteString(tomlKey(k) + " = " + value + "\n")
+	}
+
+	for _, k := range tables {
+		if err := writeTOMLTable(b, m[k].(map[string]interface{}), appendPath(path, k), false); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range arrays {
+		for _, item := range m[k].([]interface{}) {
+			if err := writeTOMLTable(b, item.(map[string]interface{}), appendPath(path, k), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isTableArray reports whether list is a non-empty list of maps.
+func isTableArray(list []interface{}) bool {
+	for _, item := range list {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+
+	return len(list) > 0
+}
+
+func appendPath(path []string, k string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), k)
+}
+
+func tomlPath(path []string) string {
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = tomlKey(k)
+	}
+
+	return strings.Join(keys, ".")
+}
+
+func tomlInline(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return quote(v), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+
+	case []interface{}:
+		items := make([]string, 0, len(v))
+
+		for _, item := range v {
+			if item == nil {
+				continue
+			}
+
+			s, err := tomlInline(item)
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, s)
+		}
+
+		return "[" + strings.Join(items, ", ") + "]", nil
+
+	case map[string]interface{}:
+		items := make([]string, 0, len(v))
+
+		for _, k := range sortedKeys(v) {
+			if v[k] == nil {
+				continue
+			}
+
+			s, err := tomlInline(v[k])
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, tomlKey(k)+" = "+s)
+		}
+
+		return "{" + strings.Join(items, ", ") + "}", nil
+
+	default:
+		return "", fmt.Errorf("unsupported value %T", v)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+)
+
+const sampleJSON = `{
+  "http": {
+    "middlewares": {
+      "public_ipwhitelist": {
+        "ipWhiteList": {"sourceRange": ["192.0.2.1/32", "2001:db8::/64"], "ipStrategy": {}}
+      },
+      "public_protected-ratelimit": {"rateLimit": {"average": 100, "burst": 50}}
+    },
+    "routers": {
+      "admin.example": {"rule": "Host(` + "`admin.example.com`" + `)", "middlewares": ["public_ipwhitelist"], "tls": null}
+    },
+    "services": {
+      "admin": {"loadBalancer": {"servers": [{"url": "http://10.0.0.2:8080"}, {"url": "http://10.0.0.3:8080"}], "passHostHeader": true}}
+    }
+  },
+  "tcp": {}
+}`
+
+func TestEncodeYAML(t *testing.T) {
+	v, err := decodeJSON([]byte(sampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeYAML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `http:
+  middlewares:
+    public_ipwhitelist:
+      ipWhiteList:
+        ipStrategy: {}
+        sourceRange:
+          - "192.0.2.1/32"
+          - "2001:db8::/64"
+    public_protected-ratelimit:
+      rateLimit:
+        average: 100
+        burst: 50
+  routers:
+    "admin.example":
+      middlewares:
+        - "public_ipwhitelist"
+      rule: "Host(` + "`admin.example.com`" + `)"
+      tls: null
+  services:
+    admin:
+      loadBalancer:
+        passHostHeader: true
+        servers:
+          - url: "http://10.0.0.2:8080"
+          - url: "http://10.0.0.3:8080"
+tcp: {}
+`
+
+	if string(data) != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", data, expected)
+	}
+}
+
+func TestEncodeTOML(t *testing.T) {
+	v, err := decodeJSON([]byte(sampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeTOML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `tcp = {}
+
+[http.middlewares.public_ipwhitelist.ipWhiteList]
+ipStrategy = {}
+sourceRange = ["192.0.2.1/32", "2001:db8::/64"]
+
+[http.middlewares.public_protected-ratelimit.rateLimit]
+average = 100
+burst = 50
+
+[http.routers."admin.example"]
+middlewares = ["public_ipwhitelist"]
+rule = "Host(` + "`admin.example.com`" + `)"
+
+[http.services.admin.loadBalancer]
+passHostHeader = true
+
+[[http.services.admin.loadBalancer.servers]]
+url = "http://10.0.0.2:8080"
+
+[[http.services.admin.loadBalancer.servers]]
+url = "http://10.0.0.3:8080"
+`
+
+	if string(data) != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", data, expected)
+	}
+}
+
+func TestEncodeNestedLists(t *testing.T) {
+	v, err := decodeJSON([]byte(`{"a": [[1, 2], [], [{"b": "c"}]], "d": [{}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yaml, err := encodeYAML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedYAML := `a:
+  - - 1
+    - 2
+  - []
+  - - b: "c"
+d:
+  - {}
+`
+
+	if string(yaml) != expectedYAML {
+		t.Errorf("got:\n%s\nwant:\n%s", yaml, expectedYAML)
+	}
+
+	toml, err := encodeTOML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTOML := `a = [[1, 2], [], [{b = "c"}]]
+
+[[d]]
+`
+
+	if string(toml) != expectedTOML {
+		t.Errorf("got:\n%s\nwant:\n%s", toml, expectedTOML)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// etcdMaxTxnOps is the default limit of operations of an etcd transaction, the server's --max-txn-ops.
+const etcdMaxTxnOps = 128
+
+// etcdStore is an etcd v3 server, spoken to through its HTTP/JSON gateway.
+type etcdStore struct {
+	endpoint  string
+	username  string
+	password  string
+	client    *http.Client
+	url       string
+	maxTxnOps int
+}
+
+// newEtcdStore returns the store of a URL like http(s)://[user:password@]host:2379.
+// With a user, a token is requested for every list and update.
+// maxTxnOps must match the --max-txn-ops of the server.
+func newEtcdStore(rawURL string, maxTxnOps int) (*etcdStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported etcd URL scheme %q, use http or https", u.Scheme)
+	}
+
+	if maxTxnOps <= 0 {
+		return nil, fmt.Errorf("the etcd transaction limit must be greater than 0")
+	}
+
+	s := &etcdStore{client: &http.Client{Timeout: 10 * time.Second}, url: u.Redacted(), maxTxnOps: maxTxnOps}
+
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+
+	u.User = nil
+	s.endpoint = strings.TrimSuffix(u.String(), "/")
+
+	return s, nil
+}
+
+func (s *etcdStore) String() string {
+	return s.url
+}
+
+// list requests the keys of the range of every prefix.
+func (s *etcdStore) list(prefixes []string) ([]string, error) {
+	token, err := s.authenticate()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, prefix := range prefixes {
+		var response struct {
+			KVs []struct {
+				Key []byte `json:"key"`
+			} `json:"kvs"`
+		}
+
+		request := map[string]interface{}{
+			"key":       []byte(prefix),
+			"range_end": prefixEnd(prefix),
+			"keys_only": true,
+		}
+
+		if err = s.post("/v3/kv/range", token, request, &response); err != nil {
+			return nil, err
+		}
+
+		for _, kv := range response.KVs {
+			keys = append(keys, string(kv.Key))
+		}
+	}
+
+	return keys, nil
+}
+
+// update puts and deletes the keys in one transaction of at most maxTxnOps operations.
+func (s *etcdStore) update(entries map[string]string, remove []string) error {
+	if len(entries) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	operations, err := kvOperations("etcd", entries, remove, s.maxTxnOps)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.authenticate()
+	if err != nil {
+		return err
+	}
+
+	success := make([]interface{}, 0, len(operations))
+
+	for _, op := range operations {
+		if op.remove {
+			success = append(success, map[string]interface{}{
+				"requestDeleteRange": map[string]interface{}{"key": []byte(op.key)},
+			})
+		} else {
+			success = append(success, map[string]interface{}{
+				"requestPut": map[string]interface{}{"key": []byte(op.key), "value": []byte(op.value)},
+			})
+		}
+	}
+
+	return s.post("/v3/kv/txn", token, map[string]interface{}{"success": success}, nil)
+}
+
+// authenticate returns a token for the user, or an empty string without a user.
+func (s *etcdStore) authenticate() (string, error) {
+	if s.username == "" {
+		return "", nil
+	}
+
+	var response struct {
+		Token string `json:"token"`
+	}
+
+	request := map[string]string{"name": s.username, "password": s.password}
+	if err := s.post("/v3/auth/authenticate", "", request, &response); err != nil {
+		return "", err
+	}
+
+	return response.Token, nil
+}
+
+// post sends request to the gateway and decodes the response into response, unless it is nil.
+// Keys and values are []byte, which encoding/json encodes as base64 as the gateway expects.
+func (s *etcdStore) post(path, token string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return kvResponseError(resp.Status, data)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, response)
+}
+
+// prefixEnd returns the end of the range of the keys starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// All keys after the prefix.
+	return []byte{0}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// exporter renders the dynamic configuration into an output and runs a hook whenever the output changed.
+type exporter struct {
+	name   string
+	render func(configuration *dynamic.Configuration) ([]byte, error)
+	writer output
+	hook   string
+}
+
+// output is where an exporter writes to.
+type output interface {
+	// write writes data, unless it is unchanged, and reports whether it did.
+	write(data []byte) (bool, error)
+	// String returns the location of the output, that is passed to the hook.
+	String() string
+}
+
+// export renders and writes configuration, and runs the hook if the file changed.
+// It reports whether the output changed, also when the hook failed afterwards.
+func (e *exporter) export(ctx context.Context, configuration *dynamic.Configuration) (bool, error) {
+	data, err := e.render(configuration)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", e.name, err)
+	}
+
+	written, err := e.writer.write(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: writing %s: %w", e.name, e.writer, err)
+	}
+
+	if !written || e.hook == "" {
+		return written, nil
+	}
+
+	if out, err := runHook(ctx, e.hook, e.writer.String()); err != nil {
+		return true, fmt.Errorf("%s: hook: %w: %s", e.name, err, out)
+	}
+
+	return true, nil
+}
+
+// runHook runs command through the shell, with the path of the written file in WHITELIST_FILE.
+func runHook(ctx context.Context, command, path string) ([]byte, error) {
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	cmd.Env = append(os.Environ(), "WHITELIST_FILE="+path)
+
+	return cmd.CombinedOutput()
+}
+
+// fileProviderRenderer renders the configuration for Traefik's file provider.
+func fileProviderRenderer(encode encoder) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		data, err := json.Marshal(configuration)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return encode(v)
+	}
+}
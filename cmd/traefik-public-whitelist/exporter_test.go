@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestExporterHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook uses a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist.nft")
+	hookLog := filepath.Join(dir, "hook.log")
+
+	e := newExporter("nftables", path, `echo "$WHITELIST_FILE" >> `+hookLog,
+		nftablesRenderer("public_ipwhitelist", "inet filter", "wl"))
+
+	for _, sourceRange := range []string{"192.0.2.10/32", "192.0.2.10/32", "192.0.2.11/32"} {
+		if _, err := e.export(context.Background(), testConfiguration(sourceRange)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook only runs when the file changed.
+	if expected := strings.Repeat(path+"\n", 2); string(data) != expected {
+		t.Errorf("got %q, expected %q", data, expected)
+	}
+}
+
+func TestExporterHookFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook uses a POSIX shell")
+	}
+
+	e := newExporter("ipset", filepath.Join(t.TempDir(), "whitelist.ipset"), "echo broken; exit 3",
+		ipsetRenderer("public_ipwhitelist", "wl"))
+
+	_, err := e.export(context.Background(), testConfiguration("192.0.2.10/32"))
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("got %v", err)
+	}
+}
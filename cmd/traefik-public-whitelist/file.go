@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// fileWriter writes the dynamic configuration to the file watched by Traefik's file provider.
+type fileWriter struct {
+	path string
+	last []byte
+}
+
+// write replaces the file with data and reports whether it did. An unchanged configuration isn't written,
+// so Traefik doesn't reload it for nothing.
+func (w *fileWriter) write(data []byte) (bool, error) {
+	if w.last == nil {
+		// The file of a previous run may be up to date already.
+		if existing, err := os.ReadFile(w.path); err == nil {
+			w.last = existing
+		}
+	}
+
+	if w.last != nil && bytes.Equal(data, w.last) {
+		return false, nil
+	}
+
+	if err := writeFileAtomic(w.path, data); err != nil {
+		return false, err
+	}
+
+	w.last = append([]byte(nil), data...)
+
+	return true, nil
+}
+
+func (w *fileWriter) String() string {
+	return w.path
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it to path,
+// so Traefik never reads a half written file. The plugin has a copy of it for its history file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// Temporary files are only readable by their owner, Traefik may run as another user.
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
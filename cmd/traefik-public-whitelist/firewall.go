@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// generatedHeader is the first line of every firewall file.
+const generatedHeader = "# Generated by traefik-public-whitelist, changes are overwritten.\n"
+
+// sourceRanges returns the IPv4 and IPv6 networks of the source range of a whitelist middleware.
+func sourceRanges(configuration *dynamic.Configuration, middleware string) ([]string, []string, error) {
+	if configuration.HTTP == nil {
+		return nil, nil, fmt.Errorf("no whitelist middleware %q", middleware)
+	}
+
+	m, ok := configuration.HTTP.Middlewares[middleware]
+	if !ok || m.IPWhiteList == nil {
+		return nil, nil, fmt.Errorf("no whitelist middleware %q", middleware)
+	}
+
+	var v4, v6 []string
+
+	for _, entry := range m.IPWhiteList.SourceRange {
+		ip, _, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ip.To4() != nil {
+			v4 = append(v4, entry)
+		} else {
+			v6 = append(v6, entry)
+		}
+	}
+
+	return v4, v6, nil
+}
+
+// nftablesRenderer renders the source range of middleware as the sets <set>_v4 and <set>_v6 of table,
+// e.g. "inet filter", for "nft -f". The sets are flushed and filled in one transaction.
+func nftablesRenderer(middleware, table, set string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		v4, v6, err := sourceRanges(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+
+		sets := []struct {
+			name     string
+			addrType string
+			elements []string
+		}{
+			{name: set + "_v4", addrType: "ipv4_addr", elements: v4},
+			{name: set + "_v6", addrType: "ipv6_addr", elements: v6},
+		}
+
+		// Declaring the sets first makes flushing them work on the first run as well.
+		fmt.Fprintf(&b, "table %s {\n", table)
+
+		for _, s := range sets {
+			fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t}\n", s.name, s.addrType)
+		}
+
+		b.WriteString("}\n")
+
+		for _, s := range sets {
+			fmt.Fprintf(&b, "flush set %s %s\n", table, s.name)
+
+			if len(s.elements) > 0 {
+				fmt.Fprintf(&b, "add element %s %s { %s }\n", table, s.name, strings.Join(s.elements, ", "))
+			}
+		}
+
+		return b.Bytes(), nil
+	}
+}
+
+// ipsetRenderer renders the source range of middleware as the hash:net sets <set>_v4 and <set>_v6 for "ipset restore".
+// Each set is filled as temporary set and swapped in, so it never is incomplete.
+func ipsetRenderer(middleware, set string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		v4, v6, err := sourceRanges(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+
+		for _, s := range []struct {
+			name     string
+			family   string
+			elements []string
+		}{
+			{name: set + "_v4", family: "inet", elements: v4},
+			{name: set + "_v6", family: "inet6", elements: v6},
+		} {
+			tmp := s.name + "_tmp"
+
+			fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", s.name, s.family)
+			fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", tmp, s.family)
+			fmt.Fprintf(&b, "flush %s\n", tmp)
+
+			for _, element := range splitDefaultRoute(s.elements) {
+				fmt.Fprintf(&b, "add %s %s\n", tmp, element)
+			}
+
+			fmt.Fprintf(&b, "swap %s %s\n", tmp, s.name)
+			fmt.Fprintf(&b, "destroy %s\n", tmp)
+		}
+
+		return b.Bytes(), nil
+	}
+}
+
+// splitDefaultRoute replaces networks with a prefix length of 0, that hash:net sets can't hold, by their two halves.
+func splitDefaultRoute(networks []string) []string {
+	result := make([]string, 0, len(networks))
+
+	for _, network := range networks {
+		switch network {
+		case "0.0.0.0/0":
+			result = append(result, "0.0.0.0/1", "128.0.0.0/1")
+		case "::/0":
+			result = append(result, "::/1", "8000::/1")
+		default:
+			result = append(result, network)
+		}
+	}
+
+	return result
+}
+
+// iptablesRenderer renders the source range of a family of middleware as rules of chain in the filter table,
+// that jump to target for every whitelisted source, for "iptables-restore --noflush" or "ip6tables-restore --noflush".
+// The chain only holds these rules, jump to it from your own rules.
+func iptablesRenderer(middleware, chain, target string, ipv6 bool) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		v4, v6, err := sourceRanges(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		sources := v4
+		if ipv6 {
+			sources = v6
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+		b.WriteString("*filter\n")
+		fmt.Fprintf(&b, ":%s - [0:0]\n", chain)
+		fmt.Fprintf(&b, "-F %s\n", chain)
+
+		for _, source := range sources {
+			fmt.Fprintf(&b, "-A %s -s %s -j %s\n", chain, source, target)
+		}
+
+		b.WriteString("COMMIT\n")
+
+		return b.Bytes(), nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+func testConfiguration(sourceRange ...string) *dynamic.Configuration {
+	return &dynamic.Configuration{
+		HTTP: &dynamic.HTTPConfiguration{
+			Middlewares: map[string]*dynamic.Middleware{
+				"public_ipwhitelist": {IPWhiteList: &dynamic.IPWhiteList{SourceRange: sourceRange}},
+			},
+		},
+	}
+}
+
+func TestNftablesRenderer(t *testing.T) {
+	render := nftablesRenderer("public_ipwhitelist", "inet filter", "public_whitelist")
+
+	data, err := render(testConfiguration("10.0.0.0/8", "192.0.2.10/32", "2001:db8:1::/64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := generatedHeader + `table inet filter {
+	set public_whitelist_v4 {
+		type ipv4_addr
+		flags interval
+	}
+	set public_whitelist_v6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet filter public_whitelist_v4
+add element inet filter public_whitelist_v4 { 10.0.0.0/8, 192.0.2.10/32 }
+flush set inet filter public_whitelist_v6
+add element inet filter public_whitelist_v6 { 2001:db8:1::/64 }
+`
+
+	if string(data) != expected {
+		t.Errorf("got\n%s\nexpected\n%s", data, expected)
+	}
+}
+
+func TestIPSetRenderer(t *testing.T) {
+	render := ipsetRenderer("public_ipwhitelist", "wl")
+
+	data, err := render(testConfiguration("0.0.0.0/0", "192.0.2.10/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := generatedHeader + `create wl_v4 hash:net family inet -exist
+create wl_v4_tmp hash:net family inet -exist
+flush wl_v4_tmp
+add wl_v4_tmp 0.0.0.0/1
+add wl_v4_tmp 128.0.0.0/1
+add wl_v4_tmp 192.0.2.10/32
+swap wl_v4_tmp wl_v4
+destroy wl_v4_tmp
+create wl_v6 hash:net family inet6 -exist
+create wl_v6_tmp hash:net family inet6 -exist
+flush wl_v6_tmp
+swap wl_v6_tmp wl_v6
+destroy wl_v6_tmp
+`
+
+	if string(data) != expected {
+		t.Errorf("got\n%s\nexpected\n%s", data, expected)
+	}
+}
+
+func TestIPTablesRenderer(t *testing.T) {
+	configuration := testConfiguration("192.0.2.10/32", "2001:db8:1::/64")
+
+	tests := []struct {
+		ipv6     bool
+		expected string
+	}{
+		{
+			expected: generatedHeader + `*filter
+:PUBLIC_WHITELIST - [0:0]
+-F PUBLIC_WHITELIST
+-A PUBLIC_WHITELIST -s 192.0.2.10/32 -j ACCEPT
+COMMIT
+`,
+		},
+		{
+			ipv6: true,
+			expected: generatedHeader + `*filter
+:PUBLIC_WHITELIST - [0:0]
+-F PUBLIC_WHITELIST
+-A PUBLIC_WHITELIST -s 2001:db8:1::/64 -j ACCEPT
+COMMIT
+`,
+		},
+	}
+
+	for _, test := range tests {
+		data, err := iptablesRenderer("public_ipwhitelist", "PUBLIC_WHITELIST", "ACCEPT", test.ipv6)(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != test.expected {
+			t.Errorf("got\n%s\nexpected\n%s", data, test.expected)
+		}
+	}
+}
+
+func TestUnknownMiddleware(t *testing.T) {
+	if _, err := nftablesRenderer("other", "inet filter", "wl")(testConfiguration()); err == nil {
+		t.Error("expected an error for a missing middleware")
+	}
+
+	if _, err := ipsetRenderer("other", "wl")(&dynamic.Configuration{}); err == nil {
+		t.Error("expected an error for a configuration without HTTP")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// serviceAccountDir holds the token, CA certificate and namespace of the service account of a pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesFieldManager is the field manager of the applied Middleware.
+const kubernetesFieldManager = "traefik-public-whitelist"
+
+// kubernetesAPI is an API of the Middleware CRD of Traefik's Kubernetes provider.
+type kubernetesAPI struct {
+	group string
+	// allowList is set for Traefik v3, that renamed ipWhiteList to ipAllowList.
+	allowList bool
+}
+
+var kubernetesAPIs = map[string]kubernetesAPI{
+	"v3":     {group: "traefik.io", allowList: true},
+	"v2":     {group: "traefik.io"},
+	"legacy": {group: "traefik.containo.us"},
+}
+
+// kubernetesName matches the DNS subdomain names Kubernetes requires for resources.
+var kubernetesName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// kubernetesMiddleware returns the Middleware resource name in namespace with the whitelist middleware.
+func kubernetesMiddleware(configuration *dynamic.Configuration, middleware string, api kubernetesAPI, name, namespace string) (map[string]interface{}, error) {
+	if configuration.HTTP == nil || configuration.HTTP.Middlewares[middleware] == nil ||
+		configuration.HTTP.Middlewares[middleware].IPWhiteList == nil {
+		return nil, fmt.Errorf("no whitelist middleware %q", middleware)
+	}
+
+	data, err := json.Marshal(configuration.HTTP.Middlewares[middleware].IPWhiteList)
+	if err != nil {
+		return nil, err
+	}
+
+	whitelist, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "ipWhiteList"
+	if api.allowList {
+		key = "ipAllowList"
+	}
+
+	return map[string]interface{}{
+		"apiVersion": api.group + "/v1alpha1",
+		"kind":       "Middleware",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{
+			key: whitelist,
+		},
+	}, nil
+}
+
+// kubernetesManifestRenderer renders the whitelist middleware as YAML manifest of a Middleware, for kubectl apply.
+func kubernetesManifestRenderer(middleware string, api kubernetesAPI, name, namespace string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		resource, err := kubernetesMiddleware(configuration, middleware, api, name, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeYAML(resource)
+	}
+}
+
+// kubernetesApplyRenderer renders the whitelist middleware as JSON Middleware for the Kubernetes API.
+func kubernetesApplyRenderer(middleware string, api kubernetesAPI, name, namespace string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		resource, err := kubernetesMiddleware(configuration, middleware, api, name, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(resource)
+	}
+}
+
+// kubernetesApplier applies the Middleware through the Kubernetes API.
+// It uses server-side apply, which creates the Middleware if it doesn't exist yet.
+type kubernetesApplier struct {
+	url       string
+	tokenFile string
+	client    *http.Client
+	last      []byte
+}
+
+// newKubernetesApplier returns the applier of the Middleware name in namespace of the API server at server.
+// The token is read from tokenFile on every request, as service account tokens are rotated.
+// The server's certificate is verified with the CA certificate in caFile, or with the system's if caFile is empty.
+func newKubernetesApplier(server string, api kubernetesAPI, name, namespace, tokenFile, caFile string) (*kubernetesApplier, error) {
+	if !kubernetesName.MatchString(name) || !kubernetesName.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid Kubernetes name %q in namespace %q", name, namespace)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	query := url.Values{"fieldManager": {kubernetesFieldManager}, "force": {"true"}}
+
+	return &kubernetesApplier{
+		url: fmt.Sprintf("%s/apis/%s/v1alpha1/namespaces/%s/middlewares/%s?%s",
+			strings.TrimSuffix(server, "/"), api.group, namespace, name, query.Encode()),
+		tokenFile: tokenFile,
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// write applies the Middleware, unless it's unchanged since it was applied last.
+func (a *kubernetesApplier) write(data []byte) (bool, error) {
+	if a.last != nil && bytes.Equal(data, a.last) {
+		return false, nil
+	}
+
+	request, err := http.NewRequest(http.MethodPatch, a.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Content-Type", "application/apply-patch+yaml")
+	request.Header.Set("Accept", "application/json")
+
+	if a.tokenFile != "" {
+		token, err := os.ReadFile(a.tokenFile)
+		if err != nil {
+			return false, err
+		}
+
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	response, err := a.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return false, err
+	}
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return false, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	a.last = append([]byte(nil), data...)
+
+	return true, nil
+}
+
+func (a *kubernetesApplier) String() string {
+	return strings.SplitN(a.url, "?", 2)[0]
+}
+
+// inClusterNamespace returns the namespace of the service account of the pod, or default outside of a cluster.
+func inClusterNamespace() string {
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "default"
+	}
+
+	return strings.TrimSpace(string(namespace))
+}
+
+// inClusterServer returns the URL of the API server of the cluster the pod runs in, or an empty string outside of a cluster.
+func inClusterServer() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+
+	return "https://" + net.JoinHostPort(host, port)
+}
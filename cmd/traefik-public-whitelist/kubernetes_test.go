@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestKubernetesManifestRenderer(t *testing.T) {
+	configuration := testConfiguration("10.0.0.0/8", "192.0.2.10/32")
+
+	tests := []struct {
+		api      string
+		expected string
+	}{
+		{
+			api: "v3",
+			expected: `apiVersion: "traefik.io/v1alpha1"
+kind: "Middleware"
+metadata:
+  name: "public-ipwhitelist"
+  namespace: "web"
+spec:
+  ipAllowList:
+    sourceRange:
+      - "10.0.0.0/8"
+      - "192.0.2.10/32"
+`,
+		},
+		{
+			api: "legacy",
+			expected: `apiVersion: "traefik.containo.us/v1alpha1"
+kind: "Middleware"
+metadata:
+  name: "public-ipwhitelist"
+  namespace: "web"
+spec:
+  ipWhiteList:
+    sourceRange:
+      - "10.0.0.0/8"
+      - "192.0.2.10/32"
+`,
+		},
+	}
+
+	for _, test := range tests {
+		render := kubernetesManifestRenderer("public_ipwhitelist", kubernetesAPIs[test.api], "public-ipwhitelist", "web")
+
+		data, err := render(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != test.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.api, data, test.expected)
+		}
+	}
+}
+
+// fakeAPIServer records the requests of the Kubernetes API server.
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+
+	w.WriteHeader(s.status)
+	w.Write([]byte(`{"kind":"Status","message":"denied"}`))
+}
+
+func TestKubernetesApplier(t *testing.T) {
+	api := &fakeAPIServer{status: http.StatusOK}
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	applier, err := newKubernetesApplier(server.URL, kubernetesAPIs["v2"], "public-ipwhitelist", "web", tokenFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &exporter{
+		name:   "Kubernetes",
+		render: kubernetesApplyRenderer("public_ipwhitelist", kubernetesAPIs["v2"], "public-ipwhitelist", "web"),
+		writer: applier,
+	}
+
+	for _, sourceRange := range []string{"192.0.2.10/32", "192.0.2.10/32"} {
+		if _, err = e.export(context.Background(), testConfiguration(sourceRange)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unchanged Middleware isn't applied again.
+	if len(api.requests) != 1 {
+		t.Fatalf("got %d requests", len(api.requests))
+	}
+
+	r := api.requests[0]
+
+	if r.Method != http.MethodPatch || r.URL.Path != "/apis/traefik.io/v1alpha1/namespaces/web/middlewares/public-ipwhitelist" {
+		t.Errorf("got %s %s", r.Method, r.URL.Path)
+	}
+
+	if r.URL.Query().Get("fieldManager") != kubernetesFieldManager || r.URL.Query().Get("force") != "true" {
+		t.Errorf("got query %s", r.URL.RawQuery)
+	}
+
+	if r.Header.Get("Content-Type") != "application/apply-patch+yaml" || r.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("got headers %v", r.Header)
+	}
+
+	var resource struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			IPWhiteList struct {
+				SourceRange []string `json:"sourceRange"`
+			} `json:"ipWhiteList"`
+		} `json:"spec"`
+	}
+
+	if err = json.Unmarshal([]byte(api.bodies[0]), &resource); err != nil {
+		t.Fatal(err)
+	}
+
+	if resource.Kind != "Middleware" || len(resource.Spec.IPWhiteList.SourceRange) != 1 {
+		t.Errorf("got %s", api.bodies[0])
+	}
+
+	// A rejected Middleware is applied again with the next configuration.
+	api.mu.Lock()
+	api.status = http.StatusForbidden
+	api.mu.Unlock()
+
+	if _, err = e.export(context.Background(), testConfiguration("192.0.2.11/32")); err == nil {
+		t.Error("expected an error for a rejected request")
+	}
+
+	api.mu.Lock()
+	api.status = http.StatusCreated
+	api.mu.Unlock()
+
+	if _, err = e.export(context.Background(), testConfiguration("192.0.2.11/32")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.requests) != 3 {
+		t.Errorf("got %d requests", len(api.requests))
+	}
+}
+
+func TestKubernetesApplierInvalidName(t *testing.T) {
+	if _, err := newKubernetesApplier("https://127.0.0.1", kubernetesAPIs["v3"], "public_ipwhitelist", "web", "", ""); err == nil {
+		t.Error("expected an error for an invalid name")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// kvStore is a key-value store watched by one of Traefik's KV providers.
+type kvStore interface {
+	// list returns the keys starting with one of prefixes.
+	list(prefixes []string) ([]string, error)
+	// update puts entries and removes keys atomically.
+	update(entries map[string]string, remove []string) error
+	String() string
+}
+
+// kvRenderer renders the configuration as JSON object of the keys and values of Traefik's KV layout below prefix,
+// e.g. traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/0.
+func kvRenderer(prefix string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		data, err := json.Marshal(configuration)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := map[string]string{}
+		flattenKV(entries, strings.TrimSuffix(prefix, "/"), v)
+
+		return json.Marshal(entries)
+	}
+}
+
+// flattenKV adds the leaves of v to entries, with the path of map keys and list indices as key.
+// Empty maps and lists and nulls have no leaves.
+func flattenKV(entries map[string]string, key string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			flattenKV(entries, key+"/"+k, child)
+		}
+
+	case []interface{}:
+		for i, child := range v {
+			flattenKV(entries, key+"/"+strconv.Itoa(i), child)
+		}
+
+	case string:
+		entries[key] = v
+
+	case json.Number:
+		entries[key] = v.String()
+
+	case bool:
+		entries[key] = strconv.FormatBool(v)
+	}
+}
+
+// kvPublisher publishes the configuration to a KV store.
+// Keys of a router, service or middleware it published, that aren't part of the configuration anymore,
+// e.g. indices beyond the end of a shrunk list, are deleted.
+type kvPublisher struct {
+	store  kvStore
+	prefix string
+
+	last      map[string]string
+	lastRoots []string
+}
+
+// write publishes the JSON encoded entries, unless they are unchanged.
+func (p *kvPublisher) write(data []byte) (bool, error) {
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return false, err
+	}
+
+	entries = keepSourceRangeSlots(entries, p.last)
+
+	if p.last != nil && equalEntries(entries, p.last) {
+		return false, nil
+	}
+
+	roots := p.roots(entries)
+
+	// Entries of a previous run below the same roots are found by listing them.
+	existing, err := p.store.list(mergeRoots(roots, p.lastRoots))
+	if err != nil {
+		return false, err
+	}
+
+	var remove []string
+
+	for _, key := range existing {
+		if _, ok := entries[key]; !ok {
+			remove = append(remove, key)
+		}
+	}
+
+	sort.Strings(remove)
+
+	changed := make(map[string]string, len(entries))
+
+	for key, value := range entries {
+		if last, ok := p.last[key]; !ok || last != value {
+			changed[key] = value
+		}
+	}
+
+	if err = p.store.update(changed, remove); err != nil {
+		return false, err
+	}
+
+	p.last = entries
+	p.lastRoots = roots
+
+	return true, nil
+}
+
+func (p *kvPublisher) String() string {
+	return p.store.String()
+}
+
+// roots returns the key prefixes of the routers, services and middlewares of entries,
+// e.g. traefik/http/middlewares/public_ipwhitelist/.
+func (p *kvPublisher) roots(entries map[string]string) []string {
+	prefix := strings.TrimSuffix(p.prefix, "/") + "/"
+	unique := map[string]bool{}
+
+	for key := range entries {
+		// protocol/kind/name, e.g. http/middlewares/public_ipwhitelist.
+		segments := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 4)
+		if len(segments) < 4 {
+			continue
+		}
+
+		unique[prefix+strings.Join(segments[:3], "/")+"/"] = true
+	}
+
+	roots := make([]string, 0, len(unique))
+	for root := range unique {
+		roots = append(roots, root)
+	}
+
+	sort.Strings(roots)
+
+	return roots
+}
+
+func mergeRoots(a, b []string) []string {
+	unique := map[string]bool{}
+	for _, root := range append(append([]string(nil), a...), b...) {
+		unique[root] = true
+	}
+
+	merged := make([]string, 0, len(unique))
+	for root := range unique {
+		merged = append(merged, root)
+	}
+
+	sort.Strings(merged)
+
+	return merged
+}
+
+func equalEntries(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortedEntries returns the keys of entries in order, so stores get the same requests for the same entries.
+func sortedEntries(entries map[string]string) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// keepSourceRangeSlots reorders the source ranges of entries, so entries that were published already keep their index.
+// The order of a source range doesn't matter, but the rendered one is sorted: without this, a new entry at the start
+// would shift all the others and rewrite every key of the list, more than fits into a transaction of etcd or Consul.
+func keepSourceRangeSlots(entries, last map[string]string) map[string]string {
+	lists := map[string][]string{}
+
+	for key, value := range entries {
+		if list := sourceRangeList(key); list != "" {
+			lists[list] = append(lists[list], value)
+		}
+	}
+
+	if len(lists) == 0 || last == nil {
+		return entries
+	}
+
+	stable := make(map[string]string, len(entries))
+
+	for key, value := range entries {
+		if sourceRangeList(key) == "" {
+			stable[key] = value
+		}
+	}
+
+	for list, values := range lists {
+		sort.Strings(values)
+
+		for i, value := range stableSlots(list, values, last) {
+			stable[list+strconv.Itoa(i)] = value
+		}
+	}
+
+	return stable
+}
+
+// stableSlots returns values in the order of the list below prefix in last,
+// values that aren't in last fill the gaps and the end in sorted order.
+func stableSlots(prefix string, values []string, last map[string]string) []string {
+	pending := make(map[string]int, len(values))
+	for _, value := range values {
+		pending[value]++
+	}
+
+	slots := make([]string, len(values))
+	filled := make([]bool, len(values))
+
+	for i := range slots {
+		if value, ok := last[prefix+strconv.Itoa(i)]; ok && pending[value] > 0 {
+			slots[i] = value
+			filled[i] = true
+			pending[value]--
+		}
+	}
+
+	next := 0
+
+	for _, value := range values {
+		if pending[value] == 0 {
+			continue
+		}
+
+		for filled[next] {
+			next++
+		}
+
+		slots[next] = value
+		filled[next] = true
+		pending[value]--
+	}
+
+	return slots
+}
+
+// sourceRangeList returns the prefix of the list key is an index of, if it is an entry of a source range,
+// e.g. traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/.
+func sourceRangeList(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i < 0 || !strings.HasSuffix(key[:i], "/sourceRange") {
+		return ""
+	}
+
+	if _, err := strconv.Atoi(key[i+1:]); err != nil {
+		return ""
+	}
+
+	return key[:i+1]
+}
+
+// kvOperation is a put, or a delete if remove is set.
+type kvOperation struct {
+	key    string
+	value  string
+	remove bool
+}
+
+// kvOperations returns the operations of an update, which must fit into one transaction of at most limit operations.
+// Splitting it up would let Traefik see a half updated configuration, so a larger update is refused.
+func kvOperations(store string, entries map[string]string, remove []string, limit int) ([]kvOperation, error) {
+	if n := len(entries) + len(remove); n > limit {
+		return nil, fmt.Errorf("update of %d keys exceeds the limit of %d operations of a %s transaction", n, limit, store)
+	}
+
+	operations := make([]kvOperation, 0, len(entries)+len(remove))
+
+	for _, key := range sortedEntries(entries) {
+		operations = append(operations, kvOperation{key: key, value: entries[key]})
+	}
+
+	for _, key := range remove {
+		operations = append(operations, kvOperation{key: key, remove: true})
+	}
+
+	return operations, nil
+}
+
+// kvResponseError returns an error with the status and the start of the body of a failed response of a store.
+func kvResponseError(status string, body []byte) error {
+	return fmt.Errorf("%s: %s", status, bytes.TrimSpace(body))
+}
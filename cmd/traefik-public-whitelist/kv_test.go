@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shoggomo/traefik_dynamic_public_whitelist"
+)
+
+func TestKVRenderer(t *testing.T) {
+	data, err := kvRenderer("traefik")(testConfiguration("10.0.0.0/8", "192.0.2.10/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries map[string]string
+	if err = json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/0": "10.0.0.0/8",
+		"traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/1": "192.0.2.10/32",
+	}
+
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got %v", entries)
+	}
+}
+
+// memoryKV is the content of a fake KV store.
+type memoryKV struct {
+	mu      sync.Mutex
+	entries map[string]string
+	updates int
+}
+
+func newMemoryKV(entries map[string]string) *memoryKV {
+	return &memoryKV{entries: entries}
+}
+
+func (m *memoryKV) keys(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (m *memoryKV) put(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = value
+}
+
+func (m *memoryKV) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+}
+
+func (m *memoryKV) snapshot() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]string, len(m.entries))
+	for key, value := range m.entries {
+		snapshot[key] = value
+	}
+
+	return snapshot
+}
+
+// newFakeRedis serves the commands the Redis store uses from kv.
+func newFakeRedis(t *testing.T, kv *memoryKV, password string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveFakeRedis(conn, kv, password)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveFakeRedis(conn net.Conn, kv *memoryKV, password string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authenticated := password == ""
+
+	var queued [][]string
+
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+
+		elements, _ := request.([]interface{})
+		args := make([]string, len(elements))
+
+		for i, element := range elements {
+			args[i], _ = element.(string)
+		}
+
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[len(args)-1] == password
+			io.WriteString(conn, "+OK\r\n")
+		case !authenticated:
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			io.WriteString(conn, "+OK\r\n")
+		case args[0] == "SCAN":
+			keys := kv.keys(strings.ReplaceAll(strings.TrimSuffix(args[3], "*"), `\`, ""))
+			io.WriteString(conn, "*2\r\n$1\r\n0\r\n"+respArray(keys))
+		case args[0] == "MULTI":
+			queued = [][]string{}
+			io.WriteString(conn, "+OK\r\n")
+		case args[0] == "EXEC":
+			for _, command := range queued {
+				if command[0] == "SET" {
+					kv.put(command[1], command[2])
+				} else {
+					for _, key := range command[1:] {
+						kv.remove(key)
+					}
+				}
+			}
+
+			kv.mu.Lock()
+			kv.updates++
+			kv.mu.Unlock()
+
+			io.WriteString(conn, "*"+strconv.Itoa(len(queued))+"\r\n"+strings.Repeat("+OK\r\n", len(queued)))
+		case queued != nil:
+			queued = append(queued, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func respArray(elements []string) string {
+	var b strings.Builder
+
+	b.WriteString("*" + strconv.Itoa(len(elements)) + "\r\n")
+
+	for _, element := range elements {
+		b.WriteString("$" + strconv.Itoa(len(element)) + "\r\n" + element + "\r\n")
+	}
+
+	return b.String()
+}
+
+// newFakeEtcd serves the gateway endpoints the etcd store uses from kv.
+func newFakeEtcd(t *testing.T, kv *memoryKV) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v3/kv/range", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The store only requests prefix ranges.
+		if !reflect.DeepEqual(request.RangeEnd, prefixEnd(string(request.Key))) {
+			http.Error(w, "unexpected range end", http.StatusBadRequest)
+			return
+		}
+
+		var response struct {
+			KVs []map[string][]byte `json:"kvs,omitempty"`
+		}
+
+		for _, key := range kv.keys(string(request.Key)) {
+			response.KVs = append(response.KVs, map[string][]byte{"key": []byte(key)})
+		}
+
+		json.NewEncoder(w).Encode(response)
+	})
+
+	mux.HandleFunc("/v3/kv/txn", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Success []struct {
+				RequestPut *struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+				} `json:"requestPut"`
+				RequestDeleteRange *struct {
+					Key []byte `json:"key"`
+				} `json:"requestDeleteRange"`
+			} `json:"success"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, op := range request.Success {
+			if op.RequestPut != nil {
+				kv.put(string(op.RequestPut.Key), string(op.RequestPut.Value))
+			} else {
+				kv.remove(string(op.RequestDeleteRange.Key))
+			}
+		}
+
+		kv.mu.Lock()
+		kv.updates++
+		kv.mu.Unlock()
+
+		w.Write([]byte(`{"succeeded":true}`))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// newFakeConsul serves the KV and transaction endpoints the Consul store uses from kv.
+func newFakeConsul(t *testing.T, kv *memoryKV, token string) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/kv/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != token {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		keys := kv.keys(strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+		if len(keys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(keys)
+	})
+
+	mux.HandleFunc("/v1/txn", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("X-Consul-Token") != token {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		var ops []struct {
+			KV struct {
+				Verb  string
+				Key   string
+				Value []byte
+			}
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(ops) > consulMaxTxnOps {
+			http.Error(w, "too many operations", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		for _, op := range ops {
+			if op.KV.Verb == "set" {
+				kv.put(op.KV.Key, string(op.KV.Value))
+			} else {
+				kv.remove(op.KV.Key)
+			}
+		}
+
+		kv.mu.Lock()
+		kv.updates++
+		kv.mu.Unlock()
+
+		w.Write([]byte(`{"Results":[],"Errors":null}`))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestKVPublisher(t *testing.T) {
+	tests := []struct {
+		desc     string
+		newStore func(t *testing.T, kv *memoryKV) kvStore
+	}{
+		{
+			desc: "Redis",
+			newStore: func(t *testing.T, kv *memoryKV) kvStore {
+				t.Helper()
+
+				store, err := newRedisStore("redis://:secret@" + newFakeRedis(t, kv, "secret") + "/2")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return store
+			},
+		},
+		{
+			desc: "etcd",
+			newStore: func(t *testing.T, kv *memoryKV) kvStore {
+				t.Helper()
+
+				store, err := newEtcdStore(newFakeEtcd(t, kv), etcdMaxTxnOps)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return store
+			},
+		},
+		{
+			desc: "Consul",
+			newStore: func(t *testing.T, kv *memoryKV) kvStore {
+				t.Helper()
+
+				store, err := newConsulStore(newFakeConsul(t, kv, "token"), "token")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return store
+			},
+		},
+	}
+
+	const (
+		whitelist = "traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/"
+		other     = "traefik/http/middlewares/other/ipWhiteList/sourceRange/0"
+	)
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.desc, func(t *testing.T) {
+			// A previous run left a longer list, another middleware belongs to someone else.
+			kv := newMemoryKV(map[string]string{
+				whitelist + "0": "10.0.0.0/8",
+				whitelist + "1": "192.0.2.9/32",
+				whitelist + "2": "198.51.100.0/24",
+				other:           "203.0.113.0/24",
+			})
+
+			e := &exporter{name: "KV", render: kvRenderer("traefik"), writer: &kvPublisher{store: test.newStore(t, kv), prefix: "traefik"}}
+
+			for _, sourceRange := range [][]string{
+				{"10.0.0.0/8", "192.0.2.10/32"},
+				{"10.0.0.0/8", "192.0.2.10/32"},
+				{"192.0.2.11/32"},
+			} {
+				if _, err := e.export(context.Background(), testConfiguration(sourceRange...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected := map[string]string{
+				whitelist + "0": "192.0.2.11/32",
+				other:           "203.0.113.0/24",
+			}
+
+			if got := kv.snapshot(); !reflect.DeepEqual(got, expected) {
+				t.Errorf("got %v", got)
+			}
+
+			// An unchanged configuration isn't published again.
+			if kv.updates != 2 {
+				t.Errorf("got %d updates", kv.updates)
+			}
+		})
+	}
+}
+
+func TestKeepSourceRangeSlots(t *testing.T) {
+	const list = "traefik/http/middlewares/public_ipwhitelist/ipWhiteList/sourceRange/"
+
+	last := map[string]string{list + "0": "192.0.2.0/32"}
+	for i := 1; i < 100; i++ {
+		last[list+strconv.Itoa(i)] = "198.51.100." + strconv.Itoa(i) + "/32"
+	}
+
+	// A new entry that sorts first replaces one that is gone, the others stay where they are.
+	entries := map[string]string{"traefik/http/routers/r/rule": "Host(`example.com`)"}
+	for i := 0; i < 100; i++ {
+		value := last[list+strconv.Itoa(i)]
+		if i == 50 {
+			value = "10.0.0.0/8"
+		}
+
+		entries[list+strconv.Itoa(99-i)] = value
+	}
+
+	stable := keepSourceRangeSlots(entries, last)
+
+	if len(stable) != len(entries) || stable["traefik/http/routers/r/rule"] != "Host(`example.com`)" {
+		t.Fatalf("got %v", stable)
+	}
+
+	var changed []string
+
+	for i := 0; i < 100; i++ {
+		key := list + strconv.Itoa(i)
+		if stable[key] != last[key] {
+			changed = append(changed, key+"="+stable[key])
+		}
+	}
+
+	if want := []string{list + "50=10.0.0.0/8"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("got %v, want %v", changed, want)
+	}
+}
+
+func TestConsulRejectsCountries(t *testing.T) {
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+
+	if err := checkConsulConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Whitelists = map[string]traefik_dynamic_public_whitelist.WhitelistConfig{"admin": {Countries: []string{"DE"}}}
+
+	if err := checkConsulConfig(config); err == nil {
+		t.Error("expected an error for the countries of a whitelist")
+	}
+}
+
+func TestKVOperationsFitOneTransaction(t *testing.T) {
+	entries := map[string]string{}
+	for i := 0; i < consulMaxTxnOps-1; i++ {
+		entries["k/"+strconv.Itoa(i)] = "v"
+	}
+
+	operations, err := kvOperations("Consul", entries, []string{"k/stale"}, consulMaxTxnOps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != consulMaxTxnOps {
+		t.Errorf("got %d operations", len(operations))
+	}
+
+	if last := operations[len(operations)-1]; !last.remove || last.key != "k/stale" {
+		t.Errorf("got %+v", last)
+	}
+
+	// An update that doesn't fit is refused instead of being split into several transactions.
+	entries["k/new"] = "v"
+
+	if _, err = kvOperations("Consul", entries, []string{"k/stale"}, consulMaxTxnOps); err == nil {
+		t.Error("expected an error for an update exceeding one transaction")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	if end := string(prefixEnd("traefik/")); end != "traefik0" {
+		t.Errorf("got %q", end)
+	}
+
+	if end := prefixEnd("a\xff"); string(end) != "b" {
+		t.Errorf("got %q", end)
+	}
+}
@@ -0,0 +1,458 @@
+// Command traefik-public-whitelist runs the public whitelist provider outside of Traefik
+// and writes its dynamic configuration to a file for Traefik's file provider.
+// It is meant for Traefik instances that can't load plugins, e.g. on air-gapped hosts or in older versions.
+//
+// It also exports the whitelist as nftables sets, ipsets or iptables rules,
+// so the host firewall can allow the public IPs for services that aren't behind Traefik,
+// and as nginx, HAProxy or Caddy configuration for services behind other proxies.
+// For Traefik's Kubernetes CRD provider, it writes or applies a Middleware resource,
+// and for fleets of Traefik instances it publishes the configuration to Redis, etcd or Consul for Traefik's KV providers.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Shoggomo/traefik_dynamic_public_whitelist"
+	"github.com/traefik/genconf/dynamic"
+)
+
+// encoder encodes the generic JSON form of the configuration.
+type encoder func(v interface{}) ([]byte, error)
+
+var encoders = map[string]encoder{
+	"yaml": encodeYAML,
+	"toml": encodeTOML,
+}
+
+// options are the command line flags.
+type options struct {
+	configFile string
+	name       string
+	middleware string
+
+	output, outputHook, format string
+
+	nftables, nftablesHook, nftablesTable, nftablesSet string
+	ipset, ipsetHook, ipsetName                        string
+	iptables, iptablesHook, ip6tables, ip6tablesHook   string
+	iptablesChain, iptablesTarget                      string
+
+	nginx, nginxHook, haproxy, haproxyHook, caddy, caddyHook, caddyMatcher string
+
+	kubernetes, kubernetesHook                              string
+	kubernetesApply                                         bool
+	kubernetesAPI, kubernetesName, kubernetesNamespace      string
+	kubernetesServer, kubernetesTokenFile, kubernetesCAFile string
+
+	redis, etcd, consul, consulToken, kvPrefix string
+	etcdMaxTxnOps                              int
+}
+
+func parseFlags() *options {
+	o := &options{}
+
+	flag.StringVar(&o.configFile, "config", "", "plugin configuration as JSON file, the defaults are used if empty")
+	flag.StringVar(&o.name, "name", "public-whitelist", "name of the provider")
+	flag.StringVar(&o.middleware, "middleware", "public_ipwhitelist", "whitelist middleware of the exports")
+
+	flag.StringVar(&o.output, "output", "", "file the dynamic configuration is written to")
+	flag.StringVar(&o.outputHook, "output-hook", "", "command run after the dynamic configuration file changed")
+	flag.StringVar(&o.format, "format", "", "yaml or toml, derived from the extension of the output file by default")
+
+	flag.StringVar(&o.nftables, "nftables", "", "file the nftables sets are written to, for nft -f")
+	flag.StringVar(&o.nftablesHook, "nftables-hook", "", "command run after the nftables file changed, e.g. nft -f \"$WHITELIST_FILE\"")
+	flag.StringVar(&o.nftablesTable, "nftables-table", "inet filter", "family and name of the table of the nftables sets")
+	flag.StringVar(&o.nftablesSet, "nftables-set", "public_whitelist", "name of the nftables sets, suffixed with _v4 and _v6")
+	flag.StringVar(&o.ipset, "ipset", "", "file the ipsets are written to, for ipset restore")
+	flag.StringVar(&o.ipsetHook, "ipset-hook", "", "command run after the ipset file changed, e.g. ipset restore -f \"$WHITELIST_FILE\"")
+	flag.StringVar(&o.ipsetName, "ipset-name", "public_whitelist", "name of the ipsets, suffixed with _v4 and _v6")
+	flag.StringVar(&o.iptables, "iptables", "", "file the IPv4 rules are written to, for iptables-restore --noflush")
+	flag.StringVar(&o.iptablesHook, "iptables-hook", "", "command run after the IPv4 rules file changed")
+	flag.StringVar(&o.ip6tables, "ip6tables", "", "file the IPv6 rules are written to, for ip6tables-restore --noflush")
+	flag.StringVar(&o.ip6tablesHook, "ip6tables-hook", "", "command run after the IPv6 rules file changed")
+	flag.StringVar(&o.iptablesChain, "iptables-chain", "PUBLIC_WHITELIST", "chain of the filter table holding the rules")
+	flag.StringVar(&o.iptablesTarget, "iptables-target", "ACCEPT", "target of the rules")
+
+	flag.StringVar(&o.nginx, "nginx", "", "file the nginx allow directives are written to, for include")
+	flag.StringVar(&o.nginxHook, "nginx-hook", "", "command run after the nginx file changed, e.g. nginx -s reload")
+	flag.StringVar(&o.haproxy, "haproxy", "", "ACL file the networks are written to, for acl <name> src -f")
+	flag.StringVar(&o.haproxyHook, "haproxy-hook", "", "command run after the HAProxy ACL file changed")
+	flag.StringVar(&o.caddy, "caddy", "", "file the Caddy snippet is written to, for import")
+	flag.StringVar(&o.caddyHook, "caddy-hook", "", "command run after the Caddy snippet changed, e.g. caddy reload")
+	flag.StringVar(&o.caddyMatcher, "caddy-matcher", "public_whitelist", "name of the Caddy snippet and its matcher")
+
+	flag.StringVar(&o.kubernetes, "kubernetes", "", "file the Middleware manifest is written to, for kubectl apply -f")
+	flag.StringVar(&o.kubernetesHook, "kubernetes-hook", "", "command run after the Middleware manifest changed")
+	flag.BoolVar(&o.kubernetesApply, "kubernetes-apply", false, "apply the Middleware through the Kubernetes API")
+	flag.StringVar(&o.kubernetesAPI, "kubernetes-api", "v3", "Middleware API: v3 (traefik.io, ipAllowList), "+
+		"v2 (traefik.io, ipWhiteList) or legacy (traefik.containo.us, ipWhiteList)")
+	flag.StringVar(&o.kubernetesName, "kubernetes-name", "", "name of the Middleware, the whitelist middleware with dashes by default")
+	flag.StringVar(&o.kubernetesNamespace, "kubernetes-namespace", "", "namespace of the Middleware, the pod's by default")
+	flag.StringVar(&o.kubernetesServer, "kubernetes-server", "", "URL of the Kubernetes API server, the pod's cluster by default")
+	flag.StringVar(&o.kubernetesTokenFile, "kubernetes-token-file", serviceAccountDir+"/token", "bearer token for the Kubernetes API")
+	flag.StringVar(&o.kubernetesCAFile, "kubernetes-ca-file", "", "CA certificate of the Kubernetes API server, "+
+		"the service account's in the pod's cluster and the system's otherwise by default")
+
+	flag.StringVar(&o.redis, "redis", "", "Redis the configuration is published to, as redis://[[user]:password@]host[:port][/db] or rediss://")
+	flag.StringVar(&o.etcd, "etcd", "", "etcd v3 the configuration is published to, as http(s)://[user:password@]host:2379")
+	flag.IntVar(&o.etcdMaxTxnOps, "etcd-max-txn-ops", etcdMaxTxnOps, "operations of an etcd transaction, the --max-txn-ops of the server")
+	flag.StringVar(&o.consul, "consul", "", "Consul agent the configuration is published to, e.g. http://127.0.0.1:8500")
+	flag.StringVar(&o.consulToken, "consul-token", os.Getenv("CONSUL_HTTP_TOKEN"), "ACL token for Consul")
+	flag.StringVar(&o.kvPrefix, "kv-prefix", "traefik", "root key of Traefik's KV providers")
+
+	flag.Parse()
+
+	return o
+}
+
+func main() {
+	o := parseFlags()
+
+	config, err := loadConfig(o.configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// From here on, messages are written in the log level and format of the configuration, like the provider's.
+	logger, err := traefik_dynamic_public_whitelist.NewLogger(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exporters, err := newExporters(o, config)
+	if err != nil {
+		logger.Error("invalid exports", "error", err)
+		os.Exit(1)
+	}
+
+	if len(exporters) == 0 {
+		logger.Error("-output or one of the exports is required")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = run(ctx, logger, config, o.name, exporters); err != nil {
+		logger.Error("provider failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// newExporters returns the exporters of the outputs set in o.
+func newExporters(o *options, config *traefik_dynamic_public_whitelist.Config) ([]*exporter, error) {
+	var exporters []*exporter
+
+	if o.output != "" {
+		encode, err := outputEncoder(o.format, o.output)
+		if err != nil {
+			return nil, err
+		}
+
+		exporters = append(exporters, newExporter("file provider", o.output, o.outputHook, fileProviderRenderer(encode)))
+	}
+
+	exporters = append(exporters, firewallExporters(o)...)
+	exporters = append(exporters, proxyExporters(o)...)
+
+	kubernetesExporters, err := newKubernetesExporters(o)
+	if err != nil {
+		return nil, err
+	}
+
+	exporters = append(exporters, kubernetesExporters...)
+
+	kvExporters, err := newKVExporters(o, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(exporters, kvExporters...), nil
+}
+
+func firewallExporters(o *options) []*exporter {
+	var exporters []*exporter
+
+	if o.nftables != "" {
+		exporters = append(exporters, newExporter("nftables", o.nftables, o.nftablesHook,
+			nftablesRenderer(o.middleware, o.nftablesTable, o.nftablesSet)))
+	}
+
+	if o.ipset != "" {
+		exporters = append(exporters, newExporter("ipset", o.ipset, o.ipsetHook, ipsetRenderer(o.middleware, o.ipsetName)))
+	}
+
+	if o.iptables != "" {
+		exporters = append(exporters, newExporter("iptables", o.iptables, o.iptablesHook,
+			iptablesRenderer(o.middleware, o.iptablesChain, o.iptablesTarget, false)))
+	}
+
+	if o.ip6tables != "" {
+		exporters = append(exporters, newExporter("ip6tables", o.ip6tables, o.ip6tablesHook,
+			iptablesRenderer(o.middleware, o.iptablesChain, o.iptablesTarget, true)))
+	}
+
+	return exporters
+}
+
+func proxyExporters(o *options) []*exporter {
+	var exporters []*exporter
+
+	if o.nginx != "" {
+		exporters = append(exporters, newExporter("nginx", o.nginx, o.nginxHook, nginxRenderer(o.middleware)))
+	}
+
+	if o.haproxy != "" {
+		exporters = append(exporters, newExporter("HAProxy", o.haproxy, o.haproxyHook, haproxyRenderer(o.middleware)))
+	}
+
+	if o.caddy != "" {
+		exporters = append(exporters, newExporter("Caddy", o.caddy, o.caddyHook, caddyRenderer(o.middleware, o.caddyMatcher)))
+	}
+
+	return exporters
+}
+
+func newKubernetesExporters(o *options) ([]*exporter, error) {
+	if o.kubernetes == "" && !o.kubernetesApply {
+		return nil, nil
+	}
+
+	api, ok := kubernetesAPIs[o.kubernetesAPI]
+	if !ok {
+		return nil, fmt.Errorf("unsupported Kubernetes API %q, use v3, v2 or legacy", o.kubernetesAPI)
+	}
+
+	name, namespace := o.kubernetesName, o.kubernetesNamespace
+	if name == "" {
+		name = strings.ReplaceAll(o.middleware, "_", "-")
+	}
+
+	if namespace == "" {
+		namespace = inClusterNamespace()
+	}
+
+	var exporters []*exporter
+
+	if o.kubernetes != "" {
+		exporters = append(exporters, newExporter("Kubernetes manifest", o.kubernetes, o.kubernetesHook,
+			kubernetesManifestRenderer(o.middleware, api, name, namespace)))
+	}
+
+	if !o.kubernetesApply {
+		return exporters, nil
+	}
+
+	server, caFile := o.kubernetesServer, o.kubernetesCAFile
+	if server == "" {
+		server = inClusterServer()
+		if server == "" {
+			return nil, fmt.Errorf("-kubernetes-server is required outside of a Kubernetes cluster")
+		}
+
+		if caFile == "" {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+
+	applier, err := newKubernetesApplier(server, api, name, namespace, o.kubernetesTokenFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(exporters, &exporter{
+		name:   "Kubernetes",
+		render: kubernetesApplyRenderer(o.middleware, api, name, namespace),
+		writer: applier,
+	}), nil
+}
+
+func newExporter(name, path, hook string, render func(*dynamic.Configuration) ([]byte, error)) *exporter {
+	return &exporter{name: name, render: render, writer: &fileWriter{path: path}, hook: hook}
+}
+
+func newKVExporters(o *options, config *traefik_dynamic_public_whitelist.Config) ([]*exporter, error) {
+	var stores []kvStore
+
+	if o.redis != "" {
+		store, err := newRedisStore(o.redis)
+		if err != nil {
+			return nil, err
+		}
+
+		stores = append(stores, store)
+	}
+
+	if o.etcd != "" {
+		store, err := newEtcdStore(o.etcd, o.etcdMaxTxnOps)
+		if err != nil {
+			return nil, err
+		}
+
+		stores = append(stores, store)
+	}
+
+	if o.consul != "" {
+		if err := checkConsulConfig(config); err != nil {
+			return nil, err
+		}
+
+		store, err := newConsulStore(o.consul, o.consulToken)
+		if err != nil {
+			return nil, err
+		}
+
+		stores = append(stores, store)
+	}
+
+	exporters := make([]*exporter, 0, len(stores))
+
+	for _, store := range stores {
+		exporters = append(exporters, &exporter{
+			name:   "KV",
+			render: kvRenderer(o.kvPrefix),
+			writer: &kvPublisher{store: store, prefix: o.kvPrefix},
+		})
+	}
+
+	return exporters, nil
+}
+
+// outputEncoder returns the encoder of format, or of the extension of output if format is empty.
+func outputEncoder(format, output string) (encoder, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(output), ".")
+		if format == "yml" {
+			format = "yaml"
+		}
+	}
+
+	encode, ok := encoders[strings.ToLower(format)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %q, use yaml or toml", format)
+	}
+
+	return encode, nil
+}
+
+// loadConfig reads the plugin configuration from a JSON file. Settings missing in the file keep their defaults.
+func loadConfig(path string) (*traefik_dynamic_public_whitelist.Config, error) {
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// retryInterval is the interval at which failed exports are retried.
+var retryInterval = 30 * time.Second
+
+// run runs the provider until ctx is done and exports every configuration it generates.
+func run(ctx context.Context, logger *traefik_dynamic_public_whitelist.Logger, config *traefik_dynamic_public_whitelist.Config,
+	name string, exporters []*exporter,
+) error {
+	provider, err := traefik_dynamic_public_whitelist.New(ctx, config, name)
+	if err != nil {
+		return err
+	}
+
+	if err = provider.Init(); err != nil {
+		return err
+	}
+
+	cfgChan := make(chan json.Marshaler)
+
+	if err = provider.Provide(cfgChan); err != nil {
+		return err
+	}
+
+	retry := time.NewTicker(retryInterval)
+	defer retry.Stop()
+
+	var (
+		configuration *dynamic.Configuration
+		failed        []*exporter
+	)
+
+	for {
+		select {
+		case payload := <-cfgChan:
+			decoded, err := decodeConfiguration(payload)
+			if err != nil {
+				logger.Error("decoding configuration failed", "error", err)
+				continue
+			}
+
+			configuration = decoded
+			failed = export(ctx, logger, exporters, configuration)
+
+		case <-retry.C:
+			// The configuration may not change for a long time, so failed exports don't wait for the next one.
+			if len(failed) > 0 {
+				failed = export(ctx, logger, failed, configuration)
+			}
+
+		case <-ctx.Done():
+			return provider.Stop()
+		}
+	}
+}
+
+// export exports configuration with every exporter and returns those that failed.
+// An exporter that fails doesn't keep the others from being updated.
+func export(ctx context.Context, logger *traefik_dynamic_public_whitelist.Logger, exporters []*exporter,
+	configuration *dynamic.Configuration,
+) []*exporter {
+	var failed []*exporter
+
+	for _, e := range exporters {
+		written, err := e.export(ctx, configuration)
+		if written {
+			logger.Info("export written", "exporter", e.name, "output", e.writer.String())
+		}
+
+		if err != nil {
+			logger.Error("export failed", "exporter", e.name, "error", err)
+
+			failed = append(failed, e)
+		}
+	}
+
+	return failed
+}
+
+// decodeConfiguration returns the dynamic configuration of a payload sent by the provider.
+func decodeConfiguration(payload json.Marshaler) (*dynamic.Configuration, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration := &dynamic.Configuration{}
+	if err = json.Unmarshal(data, configuration); err != nil {
+		return nil, err
+	}
+
+	return configuration, nil
+}
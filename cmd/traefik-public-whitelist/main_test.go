@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shoggomo/traefik_dynamic_public_whitelist"
+)
+
+func TestFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.yml")
+
+	if err := os.WriteFile(path, []byte("a: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &fileWriter{path: path}
+
+	// The file of a previous run is kept if it is up to date.
+	if written, err := w.write([]byte("a: 1\n")); err != nil || written {
+		t.Fatalf("got %t, %v", written, err)
+	}
+
+	if written, err := w.write([]byte("a: 2\n")); err != nil || !written {
+		t.Fatalf("got %t, %v", written, err)
+	}
+
+	if written, err := w.write([]byte("a: 2\n")); err != nil || written {
+		t.Fatalf("got %t, %v", written, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "a: 2\n" {
+		t.Errorf("got %q", data)
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("got %d files", len(entries))
+	}
+}
+
+func TestOutputEncoder(t *testing.T) {
+	for _, output := range []string{"dynamic.yml", "dynamic.yaml", "dynamic.toml"} {
+		if _, err := outputEncoder("", output); err != nil {
+			t.Errorf("%s: %v", output, err)
+		}
+	}
+
+	if _, err := outputEncoder("", "dynamic.json"); err == nil {
+		t.Error("expected an error for an unsupported extension")
+	}
+
+	if _, err := outputEncoder("toml", "dynamic.conf"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.10"))
+	}))
+	t.Cleanup(resolver.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.IPv4Resolver = resolver.URL
+	config.BogonPolicy = "allow"
+	config.AdditionalSourceRange = []string{"10.0.0.0/8"}
+
+	path := filepath.Join(t.TempDir(), "whitelist.toml")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	logger, err := traefik_dynamic_public_whitelist.NewLogger(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		done <- run(ctx, logger, config, "test", []*exporter{
+			newExporter("file provider", path, "", fileProviderRenderer(encodeTOML)),
+		})
+	}()
+
+	expected := `[http.middlewares.public_ipwhitelist.ipWhiteList]
+ipStrategy = {}
+sourceRange = ["10.0.0.0/8", "192.0.2.10/32"]
+`
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil && strings.Contains(string(data), expected) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, %v", data, err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
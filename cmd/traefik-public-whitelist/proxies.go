@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// sourceRange returns the source range of a whitelist middleware.
+func sourceRange(configuration *dynamic.Configuration, middleware string) ([]string, error) {
+	v4, v6, err := sourceRanges(configuration, middleware)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(v4, v6...), nil
+}
+
+// nginxRenderer renders the source range of middleware as allow directives followed by "deny all",
+// to be included in a server or location block.
+func nginxRenderer(middleware string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		networks, err := sourceRange(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+
+		for _, network := range networks {
+			fmt.Fprintf(&b, "allow %s;\n", network)
+		}
+
+		b.WriteString("deny all;\n")
+
+		return b.Bytes(), nil
+	}
+}
+
+// haproxyRenderer renders the source range of middleware as ACL file with one network per line,
+// e.g. for "acl whitelisted src -f <file>".
+func haproxyRenderer(middleware string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		networks, err := sourceRange(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+
+		for _, network := range networks {
+			b.WriteString(network + "\n")
+		}
+
+		return b.Bytes(), nil
+	}
+}
+
+// caddyRenderer renders the source range of middleware as snippet named matcher,
+// that defines the remote_ip matcher @<matcher> where it's imported.
+func caddyRenderer(middleware, matcher string) func(*dynamic.Configuration) ([]byte, error) {
+	return func(configuration *dynamic.Configuration) ([]byte, error) {
+		networks, err := sourceRange(configuration, middleware)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+
+		b.WriteString(generatedHeader)
+		fmt.Fprintf(&b, "(%s) {\n", matcher)
+
+		if len(networks) > 0 {
+			fmt.Fprintf(&b, "\t@%s remote_ip %s\n", matcher, strings.Join(networks, " "))
+		} else {
+			// remote_ip needs at least one range, an empty whitelist matches no address.
+			fmt.Fprintf(&b, "\t@%s not remote_ip 0.0.0.0/0 ::/0\n", matcher)
+		}
+
+		b.WriteString("}\n")
+
+		return b.Bytes(), nil
+	}
+}
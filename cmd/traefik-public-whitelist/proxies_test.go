@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+func TestProxyRenderers(t *testing.T) {
+	tests := []struct {
+		desc        string
+		render      func(*dynamic.Configuration) ([]byte, error)
+		sourceRange []string
+		expected    string
+	}{
+		{
+			desc:        "nginx",
+			render:      nginxRenderer("public_ipwhitelist"),
+			sourceRange: []string{"10.0.0.0/8", "2001:db8:1::/64"},
+			expected:    "allow 10.0.0.0/8;\nallow 2001:db8:1::/64;\ndeny all;\n",
+		},
+		{
+			desc:     "nginx without networks",
+			render:   nginxRenderer("public_ipwhitelist"),
+			expected: "deny all;\n",
+		},
+		{
+			desc:        "HAProxy",
+			render:      haproxyRenderer("public_ipwhitelist"),
+			sourceRange: []string{"10.0.0.0/8", "2001:db8:1::/64"},
+			expected:    "10.0.0.0/8\n2001:db8:1::/64\n",
+		},
+		{
+			desc:        "Caddy",
+			render:      caddyRenderer("public_ipwhitelist", "home"),
+			sourceRange: []string{"10.0.0.0/8", "2001:db8:1::/64"},
+			expected:    "(home) {\n\t@home remote_ip 10.0.0.0/8 2001:db8:1::/64\n}\n",
+		},
+		{
+			desc:     "Caddy without networks",
+			render:   caddyRenderer("public_ipwhitelist", "home"),
+			expected: "(home) {\n\t@home not remote_ip 0.0.0.0/0 ::/0\n}\n",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.desc, func(t *testing.T) {
+			data, err := test.render(testConfiguration(test.sourceRange...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := generatedHeader + test.expected; string(data) != expected {
+				t.Errorf("got\n%s\nexpected\n%s", data, expected)
+			}
+		})
+	}
+}
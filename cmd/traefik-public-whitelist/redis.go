@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout limits the connection to Redis, including every command sent over it.
+const redisTimeout = 10 * time.Second
+
+// redisStore is a Redis server, spoken to over RESP.
+// Every list and update uses a connection of its own, as they are rare.
+type redisStore struct {
+	address  string
+	username string
+	password string
+	db       int
+	tls      bool
+	url      string
+}
+
+// newRedisStore returns the store of a URL like redis://[[user]:password@]host[:port][/db], or rediss:// for TLS.
+func newRedisStore(rawURL string) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported Redis URL scheme %q, use redis or rediss", u.Scheme)
+	}
+
+	s := &redisStore{address: u.Host, tls: u.Scheme == "rediss", url: u.Redacted()}
+
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *redisStore) String() string {
+	return s.url
+}
+
+// list scans the keys matching the prefixes.
+func (s *redisStore) list(prefixes []string) ([]string, error) {
+	var keys []string
+
+	err := s.do(func(c *redisConn) error {
+		for _, prefix := range prefixes {
+			cursor := "0"
+
+			for {
+				reply, err := c.command("SCAN", cursor, "MATCH", redisPattern(prefix)+"*", "COUNT", "1000")
+				if err != nil {
+					return err
+				}
+
+				page, ok := reply.([]interface{})
+				if !ok || len(page) != 2 {
+					return fmt.Errorf("unexpected SCAN reply %v", reply)
+				}
+
+				found, _ := page[1].([]interface{})
+				for _, key := range found {
+					if key, ok := key.(string); ok {
+						keys = append(keys, key)
+					}
+				}
+
+				if cursor, _ = page[0].(string); cursor == "0" || cursor == "" {
+					break
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+// update sets and deletes the keys in a transaction.
+func (s *redisStore) update(entries map[string]string, remove []string) error {
+	if len(entries) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	return s.do(func(c *redisConn) error {
+		if _, err := c.command("MULTI"); err != nil {
+			return err
+		}
+
+		for _, key := range sortedEntries(entries) {
+			if _, err := c.command("SET", key, entries[key]); err != nil {
+				return err
+			}
+		}
+
+		if len(remove) > 0 {
+			if _, err := c.command(append([]string{"DEL"}, remove...)...); err != nil {
+				return err
+			}
+		}
+
+		reply, err := c.command("EXEC")
+		if err != nil {
+			return err
+		}
+
+		results, ok := reply.([]interface{})
+		if !ok {
+			return fmt.Errorf("transaction aborted")
+		}
+
+		for _, result := range results {
+			if err, ok := result.(error); ok {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// do connects, authenticates and selects the database, and runs fn.
+func (s *redisStore) do(fn func(c *redisConn) error) error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+
+	var conn net.Conn
+
+	var err error
+
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return err
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+
+		if _, err = c.command(args...); err != nil {
+			return err
+		}
+	}
+
+	if s.db != 0 {
+		if _, err = c.command("SELECT", strconv.Itoa(s.db)); err != nil {
+			return err
+		}
+	}
+
+	return fn(c)
+}
+
+// redisConn is a connection to Redis.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// command sends a command and returns its reply, or the error Redis replied with.
+// Replies are strings, int64s, nils, errors for errors within arrays, or slices of them.
+func (c *redisConn) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESP(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// redisError is an error replied by Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRESP reads a reply.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid RESP reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return redisError(line[1:]), nil
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		elements := make([]interface{}, n)
+
+		for i := range elements {
+			if elements[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return elements, nil
+	}
+
+	return nil, fmt.Errorf("invalid RESP reply %q", line)
+}
+
+// redisPattern escapes the special characters of SCAN's glob-style patterns.
+func redisPattern(s string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,576 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of an MMDB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMaxPointerDepth bounds the pointers followed while decoding a value, so a corrupt file can't loop.
+const mmdbMaxPointerDepth = 8
+
+// geoIPDatabase expands country codes into the networks of a MaxMind or DB-IP country database in the MMDB format.
+// The file is read again when its modification time or size changes.
+type geoIPDatabase struct {
+	file      string
+	countries map[string]bool // The configured countries, only their networks are kept.
+
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	networks map[string][]string // By country code, replaced as a whole on every reload.
+}
+
+// newGeoIPDatabase returns the database of file for the countries of the whitelists, or nil if none use countries.
+func newGeoIPDatabase(file string, whitelists []whitelist) (*geoIPDatabase, error) {
+	countries := map[string]bool{}
+
+	for _, wl := range whitelists {
+		for _, country := range wl.countries {
+			countries[country] = true
+		}
+	}
+
+	if len(countries) == 0 {
+		return nil, nil
+	}
+
+	if file == "" {
+		return nil, fmt.Errorf("countries require a GeoIP database")
+	}
+
+	return &geoIPDatabase{file: file, countries: countries, networks: map[string][]string{}}, nil
+}
+
+// normalizeCountries returns the country codes in upper case, or an error for a code that isn't two letters.
+func normalizeCountries(countries []string) ([]string, error) {
+	normalized := make([]string, 0, len(countries))
+
+	for _, country := range countries {
+		code := strings.ToUpper(strings.TrimSpace(country))
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q", country)
+		}
+
+		normalized = append(normalized, code)
+	}
+
+	return normalized, nil
+}
+
+// reload reads the database again, if it was modified since it was last read, and reports whether it was.
+// If the file can't be read, the previous networks are kept.
+func (g *geoIPDatabase) reload() (bool, error) {
+	info, err := os.Stat(g.file)
+	if err != nil {
+		return false, err
+	}
+
+	g.mu.Lock()
+	unchanged := info.ModTime().Equal(g.modTime) && info.Size() == g.size
+	g.mu.Unlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(g.file)
+	if err != nil {
+		return false, err
+	}
+
+	db, err := parseMMDB(data)
+	if err != nil {
+		return false, fmt.Errorf("GeoIP database %s: %w", g.file, err)
+	}
+
+	networks, err := db.countryNetworks(g.countries)
+	if err != nil {
+		return false, fmt.Errorf("GeoIP database %s: %w", g.file, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.networks, g.modTime, g.size = networks, info.ModTime(), info.Size()
+
+	return true, nil
+}
+
+// snapshot returns the networks by country. The map is never modified, a reload replaces it.
+func (g *geoIPDatabase) snapshot() map[string][]string {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.networks
+}
+
+// countrySourceRanges returns the networks of countries.
+func countrySourceRanges(networks map[string][]string, countries []string) []string {
+	var sourceRange []string
+
+	for _, country := range countries {
+		sourceRange = append(sourceRange, networks[country]...)
+	}
+
+	return sourceRange
+}
+
+// watchGeoIPDatabase checks the modification time and size of the GeoIP database every geoIPCheckInterval.
+// A replaced database is parsed again and the whitelists get the new networks of their countries,
+// while an invalid one is logged and the networks loaded before stay in effect.
+func (p *Provider) watchGeoIPDatabase(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.geoIPCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			changed, err := p.geoIP.reload()
+			if err != nil {
+				p.log.Error("reloading GeoIP database failed", "file", p.geoIP.file, "error", err)
+				continue
+			}
+
+			if changed {
+				p.log.Info("GeoIP database reloaded", "file", p.geoIP.file)
+				notify(p.regenerate)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mmdb is a parsed MMDB file.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+}
+
+func parseMMDB(file []byte) (*mmdb, error) {
+	start := bytes.LastIndex(file, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("no MMDB metadata")
+	}
+
+	metadata := &mmdbDecoder{data: file[start+len(mmdbMetadataMarker):]}
+
+	value, _, err := metadata.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metadata is no map")
+	}
+
+	db := &mmdb{}
+	db.nodeCount, _ = fields["node_count"].(uint64)
+	db.recordSize, _ = fields["record_size"].(uint64)
+	db.ipVersion, _ = fields["ip_version"].(uint64)
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	// The search tree is followed by 16 zero bytes and the data section.
+	if treeSize+16 > uint64(start) {
+		return nil, fmt.Errorf("search tree of %d nodes exceeds the file", db.nodeCount)
+	}
+
+	db.tree = file[:treeSize]
+	db.data = file[treeSize+16 : start]
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *mmdb) record(node uint64, bit int) uint64 {
+	b := db.tree[node*db.recordSize/4:]
+
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+
+		return uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+
+	default:
+		if bit == 0 {
+			return uint64(binary.BigEndian.Uint32(b))
+		}
+
+		return uint64(binary.BigEndian.Uint32(b[4:]))
+	}
+}
+
+// countryNetworks walks the search tree and returns the networks of countries, by country code.
+func (db *mmdb) countryNetworks(countries map[string]bool) (map[string][]string, error) {
+	w := &mmdbWalker{
+		db:        db,
+		decoder:   &mmdbDecoder{data: db.data},
+		countries: countries,
+		cache:     map[uint64]string{},
+		networks:  map[string][]string{},
+		ipv4Start: db.nodeCount,
+	}
+
+	// The tree of an IPv4 database is walked like the IPv4 subtree of an IPv6 one, so its bits land in the last four bytes.
+	if db.ipVersion == 4 {
+		if err := w.walk(0, [16]byte{}, 96, false); err != nil {
+			return nil, err
+		}
+
+		return w.networks, nil
+	}
+
+	// IPv4 addresses are stored as ::a.b.c.d, aliases like ::ffff:a.b.c.d point to the same subtree.
+	w.ipv4Start = 0
+	for i := 0; i < 96 && w.ipv4Start < db.nodeCount; i++ {
+		w.ipv4Start = db.record(w.ipv4Start, 0)
+	}
+
+	if err := w.walk(0, [16]byte{}, 0, true); err != nil {
+		return nil, err
+	}
+
+	if w.ipv4Start < db.nodeCount {
+		if err := w.walk(w.ipv4Start, [16]byte{}, 96, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return w.networks, nil
+}
+
+// mmdbWalker collects the networks of countries while walking the search tree.
+type mmdbWalker struct {
+	db        *mmdb
+	decoder   *mmdbDecoder
+	countries map[string]bool
+	cache     map[uint64]string // Country codes by data offset.
+	networks  map[string][]string
+	ipv4Start uint64
+}
+
+// walk visits the subtree of node, which is the network of ip with the prefix length depth of 128 bits.
+// In the IPv6 tree, the IPv4 subtree is skipped wherever it is linked.
+func (w *mmdbWalker) walk(node uint64, ip [16]byte, depth int, ipv6 bool) error {
+	for bit := 0; bit < 2; bit++ {
+		child := ip
+		if bit == 1 {
+			child[depth/8] |= 0x80 >> (depth % 8)
+		}
+
+		value := w.db.record(node, bit)
+
+		switch {
+		case value < w.db.nodeCount:
+			if ipv6 && value == w.ipv4Start {
+				continue
+			}
+
+			if depth+1 >= 128 {
+				return fmt.Errorf("search tree deeper than 128 bits")
+			}
+
+			if err := w.walk(value, child, depth+1, ipv6); err != nil {
+				return err
+			}
+
+		case value == w.db.nodeCount:
+			// No data for this network.
+
+		case value < w.db.nodeCount+16 || value-w.db.nodeCount-16 >= uint64(len(w.db.data)):
+			return fmt.Errorf("record %d points outside of the data section", value)
+
+		default:
+			if err := w.leaf(value-w.db.nodeCount-16, child, depth+1, ipv6); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// leaf adds the network of a data record, if it belongs to one of the countries.
+func (w *mmdbWalker) leaf(offset uint64, ip [16]byte, prefix int, ipv6 bool) error {
+	country, ok := w.cache[offset]
+	if !ok {
+		value, _, err := w.decoder.decode(offset, 0)
+		if err != nil {
+			return err
+		}
+
+		country = isoCode(value)
+		w.cache[offset] = country
+	}
+
+	if !w.countries[country] {
+		return nil
+	}
+
+	network := &net.IPNet{IP: net.IP(ip[:]), Mask: net.CIDRMask(prefix, 128)}
+	if !ipv6 {
+		network = &net.IPNet{IP: net.IP(ip[12:]), Mask: net.CIDRMask(prefix-96, 32)}
+	}
+
+	w.networks[country] = append(w.networks[country], network.String())
+
+	return nil
+}
+
+// isoCode returns country.iso_code of a record.
+func isoCode(record interface{}) string {
+	fields, _ := record.(map[string]interface{})
+	country, _ := fields["country"].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+
+	return code
+}
+
+// mmdbDecoder decodes values of the data section of an MMDB file.
+// Maps are decoded to map[string]interface{}, arrays to []interface{}, unsigned integers to uint64,
+// signed integers to int64, floating point numbers to float64, and 128 bit integers and bytes to []byte.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// decode returns the value at offset and the offset after it.
+func (d *mmdbDecoder) decode(offset uint64, pointers int) (interface{}, uint64, error) {
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case 1: // Pointer, its size bits hold the pointer.
+		if pointers >= mmdbMaxPointerDepth {
+			return nil, 0, fmt.Errorf("too many pointers")
+		}
+
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		value, _, err := d.decode(target, pointers+1)
+
+		return value, next, err
+
+	case 7: // Map.
+		if err = d.checkEntries(size, offset); err != nil {
+			return nil, 0, err
+		}
+
+		m := make(map[string]interface{}, size)
+
+		for i := uint64(0); i < size; i++ {
+			key, next, err := d.decode(offset, pointers)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is no string")
+			}
+
+			if m[k], offset, err = d.decode(next, pointers); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		return m, offset, nil
+
+	case 11: // Array.
+		if err = d.checkEntries(size, offset); err != nil {
+			return nil, 0, err
+		}
+
+		a := make([]interface{}, 0, size)
+
+		for i := uint64(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, pointers); err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, value)
+		}
+
+		return a, offset, nil
+
+	case 14: // Boolean, the size is the value.
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint64(len(d.data)) {
+		return nil, 0, fmt.Errorf("value at %d exceeds the data section", offset)
+	}
+
+	b := d.data[offset : offset+size]
+	next := offset + size
+
+	switch kind {
+	case 2: // UTF-8 string.
+		return string(b), next, nil
+	case 3: // Double.
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 4, 10: // Bytes, unsigned 128 bit integer.
+		return append([]byte(nil), b...), next, nil
+	case 5, 6, 9: // Unsigned 16, 32 and 64 bit integers.
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		return u, next, nil
+	case 8: // Signed 32 bit integer.
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+
+		return int64(int32(u)), next, nil
+	case 15: // Float.
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// control decodes the control byte at offset and returns the type, the size and the offset of the payload.
+// checkEntries returns an error if the size of a map or an array at offset exceeds the rest of the data section.
+// Every entry takes at least one byte, so a corrupt size is caught before allocating memory for it.
+func (d *mmdbDecoder) checkEntries(size, offset uint64) error {
+	if size > uint64(len(d.data))-offset {
+		return fmt.Errorf("%d entries at %d exceed the data section", size, offset)
+	}
+
+	return nil
+}
+
+func (d *mmdbDecoder) control(offset uint64) (int, uint64, uint64, error) {
+	if offset >= uint64(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("offset %d exceeds the data section", offset)
+	}
+
+	ctrl := d.data[offset]
+	offset++
+
+	kind := int(ctrl >> 5)
+	if kind == 0 {
+		if offset >= uint64(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("offset %d exceeds the data section", offset)
+		}
+
+		kind = 7 + int(d.data[offset])
+		offset++
+	}
+
+	size := uint64(ctrl & 0x1f)
+
+	// The size bits of a pointer are part of the pointer.
+	if kind == 1 || size < 29 {
+		return kind, size, offset, nil
+	}
+
+	extra := size - 28
+	if offset+extra > uint64(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("size at %d exceeds the data section", offset)
+	}
+
+	var n uint64
+	for _, c := range d.data[offset : offset+extra] {
+		n = n<<8 | uint64(c)
+	}
+
+	switch size {
+	case 29:
+		size = 29 + n
+	case 30:
+		size = 285 + n
+	default:
+		size = 65821 + n
+	}
+
+	return kind, size, offset + extra, nil
+}
+
+// pointer decodes a pointer from the size bits of its control byte and the bytes at offset.
+// It returns the offset it points to and the offset after it.
+func (d *mmdbDecoder) pointer(sizeBits, offset uint64) (uint64, uint64, error) {
+	length := (sizeBits>>3)&0x3 + 1
+	if offset+length > uint64(len(d.data)) {
+		return 0, 0, fmt.Errorf("pointer at %d exceeds the data section", offset)
+	}
+
+	var p uint64
+	if length != 4 {
+		p = sizeBits & 0x7
+	}
+
+	for _, c := range d.data[offset : offset+length] {
+		p = p<<8 | uint64(c)
+	}
+
+	switch length {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+
+	return p, offset + length, nil
+}
@@ -0,0 +1,346 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// mmdbRecord is a record of a node of a test database: empty, a node index or a data offset.
+type mmdbRecord struct {
+	kind  int
+	value int
+}
+
+const (
+	mmdbEmpty = iota
+	mmdbNode
+	mmdbData
+)
+
+// mmdbWriter builds country databases. IPv6 databases store IPv4 networks as ::a.b.c.d.
+type mmdbWriter struct {
+	ipVersion int
+	nodes     [][2]mmdbRecord
+	data      bytes.Buffer
+	keys      map[string]int // Offsets of keys written before, that are referenced by pointers.
+}
+
+func newMMDBWriter(ipVersion int) *mmdbWriter {
+	return &mmdbWriter{ipVersion: ipVersion, nodes: make([][2]mmdbRecord, 1), keys: map[string]int{}}
+}
+
+// insert stores the country of the network cidr.
+func (w *mmdbWriter) insert(t *testing.T, cidr, country string) {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ones, bits := network.Mask.Size()
+
+	var ip [16]byte
+
+	switch {
+	case w.ipVersion == 4:
+		copy(ip[:], network.IP)
+	case bits == 32:
+		ones += 96
+		fallthrough
+	default:
+		copy(ip[16-len(network.IP):], network.IP)
+	}
+
+	offset := w.data.Len()
+	w.writeMap(1)
+	w.writeKey("country")
+	w.writeMap(1)
+	w.writeKey("iso_code")
+	w.writeString(country)
+
+	w.set(ip, ones, mmdbRecord{kind: mmdbData, value: offset})
+}
+
+// alias links the network ip/prefix to the subtree of ::/96, like the aliases of IPv4 in real databases.
+func (w *mmdbWriter) alias(ip [16]byte, prefix int) {
+	node := 0
+	for i := 0; i < 96; i++ {
+		node = w.nodes[node][0].value
+	}
+
+	w.set(ip, prefix, mmdbRecord{kind: mmdbNode, value: node})
+}
+
+func (w *mmdbWriter) set(ip [16]byte, prefix int, record mmdbRecord) {
+	node := 0
+
+	for depth := 0; depth < prefix; depth++ {
+		bit := int(ip[depth/8]>>(7-depth%8)) & 1
+
+		if depth == prefix-1 {
+			w.nodes[node][bit] = record
+			return
+		}
+
+		if w.nodes[node][bit].kind != mmdbNode {
+			w.nodes = append(w.nodes, [2]mmdbRecord{})
+			w.nodes[node][bit] = mmdbRecord{kind: mmdbNode, value: len(w.nodes) - 1}
+		}
+
+		node = w.nodes[node][bit].value
+	}
+}
+
+func (w *mmdbWriter) writeMap(size int) {
+	w.data.WriteByte(7<<5 | byte(size))
+}
+
+func (w *mmdbWriter) writeString(s string) {
+	w.data.WriteByte(2<<5 | byte(len(s)))
+	w.data.WriteString(s)
+}
+
+// writeKey writes a pointer to a key written before, or the key itself.
+func (w *mmdbWriter) writeKey(key string) {
+	if offset, ok := w.keys[key]; ok {
+		w.data.WriteByte(1<<5 | byte(offset>>8))
+		w.data.WriteByte(byte(offset))
+
+		return
+	}
+
+	w.keys[key] = w.data.Len()
+	w.writeString(key)
+}
+
+// bytes returns the database with records of recordSize bits.
+func (w *mmdbWriter) bytes(recordSize int) []byte {
+	var file bytes.Buffer
+
+	nodeCount := len(w.nodes)
+
+	for _, node := range w.nodes {
+		var values [2]uint32
+
+		for i, record := range node {
+			switch record.kind {
+			case mmdbEmpty:
+				values[i] = uint32(nodeCount)
+			case mmdbNode:
+				values[i] = uint32(record.value)
+			case mmdbData:
+				values[i] = uint32(nodeCount + 16 + record.value)
+			}
+		}
+
+		switch recordSize {
+		case 24:
+			file.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		case 28:
+			file.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[0]>>24)<<4 | byte(values[1]>>24),
+				byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		case 32:
+			file.Write([]byte{byte(values[0] >> 24), byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[1] >> 24), byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		}
+	}
+
+	file.Write(make([]byte, 16))
+	file.Write(w.data.Bytes())
+	file.Write(mmdbMetadataMarker)
+
+	metadata := &mmdbWriter{keys: map[string]int{}}
+	metadata.writeMap(4)
+	metadata.writeString("node_count")
+	metadata.data.Write([]byte{6<<5 | 4, byte(nodeCount >> 24), byte(nodeCount >> 16), byte(nodeCount >> 8), byte(nodeCount)})
+	metadata.writeString("record_size")
+	metadata.data.Write([]byte{5<<5 | 2, 0, byte(recordSize)})
+	metadata.writeString("ip_version")
+	metadata.data.Write([]byte{5<<5 | 1, byte(w.ipVersion)})
+	metadata.writeString("languages")
+	metadata.data.Write([]byte{0<<5 | 1, 11 - 7})
+	metadata.writeString("en")
+
+	file.Write(metadata.data.Bytes())
+
+	return file.Bytes()
+}
+
+func testGeoIPDatabase(t *testing.T, networks map[string]string) *mmdbWriter {
+	t.Helper()
+
+	w := newMMDBWriter(6)
+
+	for cidr, country := range networks {
+		w.insert(t, cidr, country)
+	}
+
+	// ::ffff:0:0/96 points to the IPv4 subtree.
+	var mapped [16]byte
+	mapped[10], mapped[11] = 0xff, 0xff
+	w.alias(mapped, 96)
+
+	return w
+}
+
+func TestMMDBCountryNetworks(t *testing.T) {
+	w := testGeoIPDatabase(t, map[string]string{
+		"192.0.2.0/24":    "DE",
+		"192.0.3.0/24":    "DE",
+		"198.51.100.0/24": "AT",
+		"203.0.113.0/24":  "US",
+		"2001:db8::/32":   "DE",
+	})
+
+	for _, recordSize := range []int{24, 28, 32} {
+		db, err := parseMMDB(w.bytes(recordSize))
+		if err != nil {
+			t.Fatalf("%d bit records: %v", recordSize, err)
+		}
+
+		networks, err := db.countryNetworks(map[string]bool{"DE": true, "AT": true})
+		if err != nil {
+			t.Fatalf("%d bit records: %v", recordSize, err)
+		}
+
+		expected := map[string][]string{
+			"DE": {"2001:db8::/32", "192.0.2.0/24", "192.0.3.0/24"},
+			"AT": {"198.51.100.0/24"},
+		}
+
+		if !reflect.DeepEqual(networks, expected) {
+			t.Errorf("%d bit records: got %v", recordSize, networks)
+		}
+	}
+}
+
+func TestMMDBIPv4CountryNetworks(t *testing.T) {
+	w := newMMDBWriter(4)
+	w.insert(t, "192.0.2.0/24", "DE")
+	w.insert(t, "198.51.100.0/25", "DE")
+	w.insert(t, "203.0.113.0/24", "US")
+
+	db, err := parseMMDB(w.bytes(24))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	networks, err := db.countryNetworks(map[string]bool{"DE": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := map[string][]string{"DE": {"192.0.2.0/24", "198.51.100.0/25"}}; !reflect.DeepEqual(networks, expected) {
+		t.Errorf("got %v", networks)
+	}
+}
+
+func TestInvalidMMDB(t *testing.T) {
+	valid := testGeoIPDatabase(t, map[string]string{"192.0.2.0/24": "DE"}).bytes(24)
+
+	// withRecord returns a database whose record is data.
+	withRecord := func(data ...byte) []byte {
+		w := testGeoIPDatabase(t, map[string]string{"192.0.2.0/24": "DE"})
+		w.data.Reset()
+		w.data.Write(data)
+
+		return w.bytes(24)
+	}
+
+	for name, data := range map[string][]byte{
+		"no metadata": []byte("not a database"),
+		"truncated":   valid[len(valid)/2:],
+		"bad tree":    append(bytes.Repeat([]byte{0xff}, 6), valid[6:]...),
+		// Millions of entries in a data section of a few bytes.
+		"oversized map":   withRecord(7<<5|31, 0xff, 0xff, 0xff),
+		"oversized array": withRecord(0<<5|31, 11-7, 0xff, 0xff, 0xff),
+	} {
+		db, err := parseMMDB(data)
+		if err == nil {
+			_, err = db.countryNetworks(map[string]bool{"DE": true})
+		}
+
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCountryValidation(t *testing.T) {
+	config := testConfig()
+	config.Countries = []string{"Germany"}
+	config.GeoIPDatabase = "/nonexistent.mmdb"
+
+	if _, err := newProvider(nil, config, "test"); err == nil {
+		t.Error("expected an error for an invalid country code")
+	}
+
+	config = testConfig()
+	config.Whitelists = map[string]WhitelistConfig{"eu": {Countries: []string{"de"}}}
+
+	if _, err := newProvider(nil, config, "test"); err == nil {
+		t.Error("expected an error for countries without a database")
+	}
+}
+
+func TestCountriesAreWhitelisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+
+	write := func(networks map[string]string, modTime time.Time) {
+		if err := os.WriteFile(path, testGeoIPDatabase(t, networks).bytes(24), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(map[string]string{"192.0.2.0/24": "DE", "192.0.3.0/24": "DE", "198.51.100.0/24": "AT"}, time.Unix(1000, 0))
+
+	config := testConfig()
+	config.Countries = []string{"de"}
+	config.GeoIPDatabase = path
+
+	clock := newFakeClock()
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "203.0.113.1"}}}
+
+	_, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv4))
+
+	// Adjacent networks of a country are aggregated.
+	if got, want := nextSourceRange(t, cfgChan), []string{"192.0.2.0/23", "203.0.113.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	write(map[string]string{"192.0.2.0/24": "DE"}, time.Unix(2000, 0))
+
+	// The watcher starts concurrently, so the clock is advanced until its ticker picked up the change.
+	deadline := time.After(5 * time.Second)
+
+	for {
+		clock.Advance(time.Minute)
+
+		select {
+		case data := <-cfgChan:
+			got := data.(*dynamic.JSONPayload).Configuration.HTTP.Middlewares[whitelistMiddleware].IPWhiteList.SourceRange
+			if want := []string{"192.0.2.0/24", "203.0.113.1/32"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("after the reload: got %v, want %v", got, want)
+			}
+
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("the database was not reloaded")
+		}
+	}
+}
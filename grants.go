@@ -0,0 +1,263 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Origins of grants.
+const (
+	grantOriginAPI  = "api"
+	grantOriginFile = "file"
+)
+
+// grant temporarily whitelists a source range in a whitelist middleware.
+type grant struct {
+	SourceRange string    `json:"sourceRange"`
+	Middleware  string    `json:"middleware,omitempty"`
+	Expires     time.Time `json:"expires"`
+	Comment     string    `json:"comment,omitempty"`
+	Origin      string    `json:"origin,omitempty"`
+}
+
+// grantLimits are the shortest prefix lengths of granted networks, so a grant can't open a whitelist to everyone.
+type grantLimits struct {
+	ipv4 int
+	ipv6 int
+}
+
+func newGrantLimits(ipv4, ipv6 int) (grantLimits, error) {
+	if ipv4 < 0 || ipv4 > 32 || ipv6 < 0 || ipv6 > 128 {
+		return grantLimits{}, fmt.Errorf("invalid minimum grant prefix lengths /%d and /%d", ipv4, ipv6)
+	}
+
+	return grantLimits{ipv4: ipv4, ipv6: ipv6}, nil
+}
+
+// check returns an error if sourceRange is a network wider than the limit of its family.
+func (l grantLimits) check(sourceRange string) error {
+	if !strings.Contains(sourceRange, "/") {
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(strings.TrimSpace(sourceRange))
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %q", sourceRange)
+	}
+
+	ones, bits := network.Mask.Size()
+
+	limit := l.ipv6
+	if network.IP.To4() != nil {
+		ones -= bits - 32
+		limit = l.ipv4
+	}
+
+	if ones < limit {
+		return fmt.Errorf("grant for %s is wider than /%d", sourceRange, limit)
+	}
+
+	return nil
+}
+
+// validate checks the grant and defaults its middleware to public_ipwhitelist.
+func (g *grant) validate(p *Provider) error {
+	if _, err := parseIPRange(g.SourceRange); err != nil {
+		return err
+	}
+
+	if err := p.grantLimits.check(g.SourceRange); err != nil {
+		return err
+	}
+
+	if g.Middleware == "" {
+		g.Middleware = whitelistMiddleware
+	}
+
+	if !p.hasWhitelist(g.Middleware) {
+		return fmt.Errorf("unknown whitelist middleware %q", g.Middleware)
+	}
+
+	if g.Expires.IsZero() {
+		return fmt.Errorf("grant for %s has no expiry", g.SourceRange)
+	}
+
+	return nil
+}
+
+// grantStore holds the grants added through the admin API and the grants of the grants file.
+type grantStore struct {
+	file string
+
+	mu          sync.Mutex
+	grants      []grant
+	fileGrants  []grant
+	fileModTime time.Time
+	fileSize    int64
+}
+
+func (s *grantStore) add(g grant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.grants = append(s.grants, g)
+}
+
+// remove deletes the grants added through the admin API for sourceRange in middleware
+// and returns how many were deleted.
+func (s *grantStore) remove(sourceRange, middleware string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]grant, 0, len(s.grants))
+
+	for _, g := range s.grants {
+		if g.SourceRange != sourceRange || g.Middleware != middleware {
+			kept = append(kept, g)
+		}
+	}
+
+	removed := len(s.grants) - len(kept)
+	s.grants = kept
+
+	return removed
+}
+
+// active returns all grants that didn't expire at now, sorted by expiry.
+// Expired grants of the admin API are dropped for good.
+func (s *grantStore) active(now time.Time) []grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]grant, 0, len(s.grants))
+
+	for _, g := range s.grants {
+		if g.Expires.After(now) {
+			kept = append(kept, g)
+		}
+	}
+
+	s.grants = kept
+
+	active := append(make([]grant, 0, len(kept)+len(s.fileGrants)), kept...)
+
+	for _, g := range s.fileGrants {
+		if g.Expires.After(now) {
+			active = append(active, g)
+		}
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].Expires.Before(active[j].Expires)
+	})
+
+	return active
+}
+
+// reloadFile reads the grants file again, if it was modified since it was last read, and reports whether it was.
+// If the file is invalid, the previous grants are kept and the error is only returned once, until the file changes again.
+func (s *grantStore) reloadFile(p *Provider) (bool, error) {
+	info, err := os.Stat(s.file)
+	if os.IsNotExist(err) {
+		info = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info == nil {
+		changed := len(s.fileGrants) > 0 || !s.fileModTime.IsZero()
+		s.fileGrants, s.fileModTime, s.fileSize = nil, time.Time{}, 0
+
+		return changed, nil
+	}
+
+	if info.ModTime().Equal(s.fileModTime) && info.Size() == s.fileSize {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, err
+	}
+
+	s.fileModTime, s.fileSize = info.ModTime(), info.Size()
+
+	var grants []grant
+	if err = json.Unmarshal(data, &grants); err != nil {
+		return false, fmt.Errorf("grants file %s: %w", s.file, err)
+	}
+
+	for i := range grants {
+		if err = grants[i].validate(p); err != nil {
+			return false, fmt.Errorf("grants file %s: %w", s.file, err)
+		}
+
+		grants[i].Origin = grantOriginFile
+	}
+
+	s.fileGrants = grants
+
+	return true, nil
+}
+
+// watchGrantsFile reloads the grants file every grantsFileCheckInterval
+// and regenerates the configuration when it changed.
+func (p *Provider) watchGrantsFile(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.grantsFileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			changed, err := p.grants.reloadFile(p)
+			if err != nil {
+				p.log.Error("reloading grants file failed", "file", p.grants.file, "error", err)
+				continue
+			}
+
+			if changed {
+				p.log.Info("grants file reloaded", "file", p.grants.file)
+				notify(p.regenerate)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// grantSourceRanges returns the source ranges granted in middleware.
+func grantSourceRanges(grants []grant, middleware string) []string {
+	var sourceRange []string
+
+	for _, g := range grants {
+		if g.Middleware == middleware {
+			sourceRange = append(sourceRange, g.SourceRange)
+		}
+	}
+
+	return sourceRange
+}
+
+// nextExpiry returns the earliest expiry of grants, or the zero time if there are none.
+func nextExpiry(grants []grant) time.Time {
+	var next time.Time
+
+	for _, g := range grants {
+		if next.IsZero() || g.Expires.Before(next) {
+			next = g.Expires
+		}
+	}
+
+	return next
+}
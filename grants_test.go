@@ -0,0 +1,51 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInvalidGrantsFileIsReportedOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grants.json")
+
+	config := testConfig()
+	config.GrantsFile = path
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(data string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[{"sourceRange": "not an IP", "expires": "2031-01-01T00:00:00Z"}]`, time.Unix(1000, 0))
+
+	if _, err = p.grants.reloadFile(p); err == nil {
+		t.Fatal("expected an error for an invalid grants file")
+	}
+
+	if changed, err := p.grants.reloadFile(p); changed || err != nil {
+		t.Errorf("unchanged invalid file: got %t, %v", changed, err)
+	}
+
+	write(`[{"sourceRange": "203.0.113.7", "expires": "2031-01-01T00:00:00Z"}]`, time.Unix(2000, 0))
+
+	if changed, err := p.grants.reloadFile(p); !changed || err != nil {
+		t.Errorf("fixed file: got %t, %v", changed, err)
+	}
+
+	if grants := p.grants.active(time.Unix(3000, 0)); len(grants) != 1 || grants[0].SourceRange != "203.0.113.7" {
+		t.Errorf("got grants %+v", grants)
+	}
+}
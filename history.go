@@ -0,0 +1,291 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyEntry a previous public address, that is still whitelisted.
+type historyEntry struct {
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// ipv6 reports whether the entry is an IPv6 network.
+func (e historyEntry) ipv6() bool {
+	return strings.Contains(e.Address, ":")
+}
+
+// historyState is the content of the history file.
+type historyState struct {
+	Current  map[string]historyCurrent `json:"current,omitempty"`
+	Previous []historyEntry            `json:"previous"`
+
+	// Files written before WANs existed hold the current IPs of the only WAN at the top level.
+	IPv4     string `json:"ipv4,omitempty"`
+	IPv6CIDR string `json:"ipv6CIDR,omitempty"`
+}
+
+// historyCurrent the current public IPs of a WAN in the history file.
+type historyCurrent struct {
+	IPv4     string `json:"ipv4,omitempty"`
+	IPv6CIDR string `json:"ipv6CIDR,omitempty"`
+}
+
+// ipHistory remembers the previous public addresses, so they stay whitelisted for a while after a change.
+// Per family, it keeps the last size addresses, and with a retention only those that were seen within it.
+type ipHistory struct {
+	size      int
+	retention time.Duration
+	file      string
+
+	mu       sync.Mutex
+	current  wanAddresses
+	previous []historyEntry // Most recently seen first.
+}
+
+func newIPHistory(size int, retention string, file string) (*ipHistory, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("IP history size must not be negative")
+	}
+
+	h := &ipHistory{size: size, file: file, current: wanAddresses{}}
+
+	if retention != "" {
+		var err error
+
+		h.retention, err = time.ParseDuration(retention)
+		if err != nil || h.retention < 0 {
+			return nil, fmt.Errorf("invalid IP history retention %q", retention)
+		}
+	}
+
+	return h, nil
+}
+
+// enabled reports whether previous addresses are kept at all.
+func (h *ipHistory) enabled() bool {
+	return h.size > 0 || h.retention > 0
+}
+
+// record takes note of the public addresses of the WANs resolved at now and moves the replaced ones into the history.
+// It reports whether the history changed.
+func (h *ipHistory) record(now time.Time, ipAddresses wanAddresses) bool {
+	if !h.enabled() {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := false
+
+	for name, addresses := range ipAddresses {
+		current := h.current[name]
+
+		changed = h.replace(now, &current.v4, addresses.v4) || changed
+		changed = h.replace(now, &current.v6CIDR, addresses.v6CIDR) || changed
+
+		h.current[name] = current
+	}
+
+	return h.prune(now) || changed
+}
+
+// replace moves current into the history, if it is replaced by a different, known address.
+func (h *ipHistory) replace(now time.Time, current *string, address string) bool {
+	if address == "" || address == *current {
+		return false
+	}
+
+	kept := make([]historyEntry, 0, len(h.previous)+1)
+
+	if *current != "" {
+		kept = append(kept, historyEntry{Address: *current, LastSeen: now})
+	}
+
+	// An address that is current again is no previous address.
+	for _, e := range h.previous {
+		if e.Address != address && e.Address != *current {
+			kept = append(kept, e)
+		}
+	}
+
+	*current = address
+	h.previous = kept
+
+	return true
+}
+
+// prune drops the entries beyond the size of a family and the entries that were last seen before the retention.
+func (h *ipHistory) prune(now time.Time) bool {
+	kept := make([]historyEntry, 0, len(h.previous))
+
+	var v4, v6 int
+
+	for _, e := range h.previous {
+		count := &v4
+		if e.ipv6() {
+			count = &v6
+		}
+
+		if h.size > 0 && *count >= h.size {
+			continue
+		}
+
+		if h.retention > 0 && !e.LastSeen.Add(h.retention).After(now) {
+			continue
+		}
+
+		*count++
+
+		kept = append(kept, e)
+	}
+
+	changed := len(kept) != len(h.previous)
+	h.previous = kept
+
+	return changed
+}
+
+// entries returns the previous addresses that are still whitelisted at now.
+func (h *ipHistory) entries(now time.Time) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.prune(now)
+
+	return append(make([]historyEntry, 0, len(h.previous)), h.previous...)
+}
+
+// nextExpiry returns the time at which the first of entries leaves the history, or the zero time.
+func (h *ipHistory) nextExpiry(entries []historyEntry) time.Time {
+	if h.retention <= 0 {
+		return time.Time{}
+	}
+
+	var next time.Time
+
+	for _, e := range entries {
+		next = earliest(next, e.LastSeen.Add(h.retention))
+	}
+
+	return next
+}
+
+// historySourceRanges returns the previous addresses of the whitelisted families.
+func historySourceRanges(entries []historyEntry, ipv4, ipv6 bool) []string {
+	var sourceRange []string
+
+	for _, e := range entries {
+		if (e.ipv6() && ipv6) || (!e.ipv6() && ipv4) {
+			sourceRange = append(sourceRange, e.Address)
+		}
+	}
+
+	return sourceRange
+}
+
+// load restores the history from the history file, if there is one.
+func (h *ipHistory) load() error {
+	if h.file == "" || !h.enabled() {
+		return nil
+	}
+
+	data, err := os.ReadFile(h.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state historyState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("history file %s: %w", h.file, err)
+	}
+
+	for _, e := range state.Previous {
+		if _, err = parseIPRange(e.Address); err != nil {
+			return fmt.Errorf("history file %s: %w", h.file, err)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.current = make(wanAddresses, len(state.Current))
+	for name, current := range state.Current {
+		h.current[name] = IPAddresses{v4: current.IPv4, v6CIDR: current.IPv6CIDR}
+	}
+
+	if state.Current == nil && (state.IPv4 != "" || state.IPv6CIDR != "") {
+		h.current[defaultWAN] = IPAddresses{v4: state.IPv4, v6CIDR: state.IPv6CIDR}
+	}
+
+	h.previous = state.Previous
+
+	return nil
+}
+
+// save writes the history to the history file. The file is replaced atomically, so it's never read half written.
+func (h *ipHistory) save() error {
+	if h.file == "" || !h.enabled() {
+		return nil
+	}
+
+	h.mu.Lock()
+	state := historyState{
+		Current:  make(map[string]historyCurrent, len(h.current)),
+		Previous: append(make([]historyEntry, 0, len(h.previous)), h.previous...),
+	}
+
+	for name, current := range h.current {
+		state.Current[name] = historyCurrent{IPv4: current.v4, IPv6CIDR: current.v6CIDR}
+	}
+	h.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(h.file, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it to path.
+// The data is synced before the rename, so a crash leaves either the old or the new file, never a truncated one.
+// The command has a copy of it, the plugin can't share code with it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// Temporary files are only readable by their owner, other tools may run as another user.
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,192 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func historyAddresses(entries []historyEntry) []string {
+	addresses := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addresses = append(addresses, e.Address)
+	}
+
+	return addresses
+}
+
+func TestIPHistorySize(t *testing.T) {
+	h, err := newIPHistory(2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, v4 := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.2"} {
+		h.record(now.Add(time.Duration(i)*time.Hour), wanAddresses{defaultWAN: IPAddresses{v4: v4, v6CIDR: "2001:db8::/64"}})
+	}
+
+	// 192.0.2.2 is current again, so it's no longer a previous address.
+	expected := []string{"192.0.2.4", "192.0.2.3"}
+	if got := historyAddresses(h.entries(now)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+
+	// The families are limited separately.
+	h.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.2", v6CIDR: "2001:db8:1::/64"}})
+
+	expected = []string{"2001:db8::/64", "192.0.2.4", "192.0.2.3"}
+	if got := historyAddresses(h.entries(now)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+
+	// A failed resolution doesn't replace an address.
+	if h.record(now, wanAddresses{defaultWAN: IPAddresses{}}) {
+		t.Error("an empty resolution changed the history")
+	}
+}
+
+func TestIPHistoryRetention(t *testing.T) {
+	h, err := newIPHistory(0, "1h", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	h.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.1"}})
+	h.record(now.Add(10*time.Minute), wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.2"}})
+	h.record(now.Add(20*time.Minute), wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.3"}})
+
+	entries := h.entries(now.Add(20 * time.Minute))
+
+	if expected := []string{"192.0.2.2", "192.0.2.1"}; !reflect.DeepEqual(historyAddresses(entries), expected) {
+		t.Errorf("got %v, want %v", historyAddresses(entries), expected)
+	}
+
+	if next := h.nextExpiry(entries); !next.Equal(now.Add(70 * time.Minute)) {
+		t.Errorf("unexpected expiry %s", next)
+	}
+
+	if expected := []string{"192.0.2.2"}; !reflect.DeepEqual(historyAddresses(h.entries(now.Add(70*time.Minute))), expected) {
+		t.Errorf("got %v, want %v", historyAddresses(h.entries(now.Add(70*time.Minute))), expected)
+	}
+}
+
+func TestIPHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	h, err := newIPHistory(3, "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.1"}})
+	h.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.2"}})
+
+	if err = h.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0o644 {
+		t.Errorf("got mode %s", info.Mode().Perm())
+	}
+
+	restored, err := newIPHistory(3, "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = restored.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address that was current before the restart is replaced on the first resolution.
+	restored.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.3"}})
+
+	expected := []string{"192.0.2.2", "192.0.2.1"}
+	if got := historyAddresses(restored.entries(now)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+}
+
+func TestIPHistoryFileWithoutWANs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	// The format before WANs existed, with the current IPs at the top level.
+	data := `{
+  "ipv4": "192.0.2.2",
+  "ipv6CIDR": "2001:db8:2::/64",
+  "previous": [{"address": "192.0.2.1", "lastSeen": "2021-03-01T11:00:00Z"}]
+}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newIPHistory(3, "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The current IPs belong to the default WAN, so they become previous addresses when they change.
+	h.record(now, wanAddresses{defaultWAN: IPAddresses{v4: "192.0.2.3", v6CIDR: "2001:db8:2::/64"}})
+
+	expected := []string{"192.0.2.2", "192.0.2.1"}
+	if got := historyAddresses(h.entries(now)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, want %v", got, expected)
+	}
+}
+
+func TestInvalidIPHistory(t *testing.T) {
+	if _, err := newIPHistory(-1, "", ""); err == nil {
+		t.Error("expected an error for a negative size")
+	}
+
+	if _, err := newIPHistory(0, "soon", ""); err == nil {
+		t.Error("expected an error for an invalid retention")
+	}
+}
+
+func TestPreviousIPsStayWhitelisted(t *testing.T) {
+	config := testConfig()
+	config.IPHistoryRetention = "12m"
+
+	clock := newFakeClock()
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}, {ip: "192.0.2.2"}}}
+
+	_, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv4))
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.1/32"}) {
+		t.Errorf("first poll: got %v", got)
+	}
+
+	clock.Advance(300 * time.Second)
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.1/32", "192.0.2.2/32"}) {
+		t.Errorf("after the change: got %v", got)
+	}
+
+	clock.Advance(300 * time.Second)
+	nextSourceRange(t, cfgChan)
+	clock.Advance(300 * time.Second)
+	nextSourceRange(t, cfgChan)
+
+	// The previous address is removed when the retention ends, before the next poll.
+	clock.Advance(120 * time.Second)
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.2/32"}) {
+		t.Errorf("after the retention: got %v", got)
+	}
+}
@@ -0,0 +1,309 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipRange is an inclusive range of addresses of a single address family.
+// IPv4 addresses are stored in the last four bytes of the arrays.
+type ipRange struct {
+	ipv6  bool
+	first [16]byte
+	last  [16]byte
+}
+
+func (r ipRange) bits() int {
+	if r.ipv6 {
+		return 128
+	}
+
+	return 32
+}
+
+// parseIPRange parses a single IP address or a CIDR into an ipRange.
+// IPv4-mapped IPv6 notations are treated as IPv4, like Traefik does when matching.
+func parseIPRange(entry string) (ipRange, error) {
+	entry = strings.TrimSpace(entry)
+
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("invalid IP address: %q", entry)
+		}
+
+		return ipRangeFromIP(ip, -1), nil
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return ipRange{}, fmt.Errorf("invalid CIDR: %q", entry)
+	}
+
+	ones, bits := network.Mask.Size()
+	if network.IP.To4() != nil && bits == 128 {
+		ones -= 96
+	}
+
+	return ipRangeFromIP(network.IP, ones), nil
+}
+
+// ipRangeFromIP returns the range of the network of ip with the given prefix length.
+// A negative prefix length selects the single address ip.
+func ipRangeFromIP(ip net.IP, prefix int) ipRange {
+	var r ipRange
+
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(r.first[12:], ip4)
+	} else {
+		r.ipv6 = true
+		copy(r.first[:], ip.To16())
+	}
+
+	if prefix < 0 {
+		prefix = r.bits()
+	}
+
+	r.first = andNot16(r.first, lowBits(r.bits()-prefix))
+	r.last = or16(r.first, lowBits(r.bits()-prefix))
+
+	return r
+}
+
+// aggregateSourceRange deduplicates the given IPs and CIDRs, drops entries contained in others,
+// removes every address covered by excluded and merges adjacent networks into a minimal, sorted list of CIDRs.
+func aggregateSourceRange(entries, excluded []string) ([]string, error) {
+	ranges, err := parseIPRanges(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	excludedRanges, err := parseIPRanges(excluded)
+	if err != nil {
+		return nil, err
+	}
+
+	return rangesToCIDRs(subtractIPRanges(mergeIPRanges(ranges), mergeIPRanges(excludedRanges))), nil
+}
+
+func parseIPRanges(entries []string) ([]ipRange, error) {
+	ranges := make([]ipRange, 0, len(entries))
+
+	for _, entry := range entries {
+		r, err := parseIPRange(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+// mergeIPRanges returns the sorted union of ranges, with overlapping and adjacent ranges joined.
+func mergeIPRanges(ranges []ipRange) []ipRange {
+	sorted := make([]ipRange, len(ranges))
+	copy(sorted, ranges)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ipv6 != sorted[j].ipv6 {
+			return !sorted[i].ipv6
+		}
+
+		return compare16(sorted[i].first, sorted[j].first) < 0
+	})
+
+	merged := make([]ipRange, 0, len(sorted))
+
+	for _, r := range sorted {
+		if len(merged) == 0 {
+			merged = append(merged, r)
+			continue
+		}
+
+		cur := &merged[len(merged)-1]
+
+		if cur.ipv6 == r.ipv6 && touches(*cur, r) {
+			if compare16(r.last, cur.last) > 0 {
+				cur.last = r.last
+			}
+
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// touches reports whether r, which does not start before cur, overlaps or directly follows cur.
+func touches(cur, r ipRange) bool {
+	if compare16(r.first, cur.last) <= 0 {
+		return true
+	}
+
+	next, ok := increment16(cur.last, cur.bits())
+
+	return ok && next == r.first
+}
+
+// subtractIPRanges removes the addresses of excluded from ranges, splitting ranges where needed.
+// Both arguments must be merged, the result is merged as well.
+func subtractIPRanges(ranges, excluded []ipRange) []ipRange {
+	result := ranges
+
+	for _, ex := range excluded {
+		remaining := make([]ipRange, 0, len(result)+1)
+
+		for _, r := range result {
+			if r.ipv6 != ex.ipv6 || compare16(ex.last, r.first) < 0 || compare16(ex.first, r.last) > 0 {
+				remaining = append(remaining, r)
+				continue
+			}
+
+			if compare16(ex.first, r.first) > 0 {
+				last, _ := decrement16(ex.first)
+				remaining = append(remaining, ipRange{ipv6: r.ipv6, first: r.first, last: last})
+			}
+
+			if compare16(ex.last, r.last) < 0 {
+				first, _ := increment16(ex.last, r.bits())
+				remaining = append(remaining, ipRange{ipv6: r.ipv6, first: first, last: r.last})
+			}
+		}
+
+		result = remaining
+	}
+
+	return result
+}
+
+// rangesToCIDRs splits each range into the smallest number of CIDRs covering it exactly.
+func rangesToCIDRs(ranges []ipRange) []string {
+	var cidrs []string
+
+	for _, r := range ranges {
+		bits := r.bits()
+		cur := r.first
+
+		for {
+			host := bits
+			for host > 0 {
+				mask := lowBits(host)
+				if and16(cur, mask) == ([16]byte{}) && compare16(or16(cur, mask), r.last) <= 0 {
+					break
+				}
+				host--
+			}
+
+			cidrs = append(cidrs, formatAddr(cur, r.ipv6)+"/"+strconv.Itoa(bits-host))
+
+			end := or16(cur, lowBits(host))
+			if end == r.last {
+				break
+			}
+
+			cur, _ = increment16(end, bits)
+		}
+	}
+
+	return cidrs
+}
+
+func formatAddr(addr [16]byte, ipv6 bool) string {
+	if !ipv6 {
+		return net.IP(addr[12:]).String()
+	}
+
+	ip := net.IP(addr[:])
+	if ip.To4() != nil {
+		// net.IP would print an IPv4-mapped address in dotted notation,
+		// which would turn it into an IPv4 network when parsed back.
+		return fmt.Sprintf("::ffff:%x:%x", uint16(addr[12])<<8|uint16(addr[13]), uint16(addr[14])<<8|uint16(addr[15]))
+	}
+
+	return ip.String()
+}
+
+// lowBits returns a 128-bit value with the n lowest bits set.
+func lowBits(n int) [16]byte {
+	var m [16]byte
+
+	for i := 15; i >= 0 && n > 0; i-- {
+		if n >= 8 {
+			m[i] = 0xff
+			n -= 8
+		} else {
+			m[i] = byte(1<<uint(n) - 1)
+			n = 0
+		}
+	}
+
+	return m
+}
+
+func compare16(a, b [16]byte) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func and16(a, b [16]byte) [16]byte {
+	for i := range a {
+		a[i] &= b[i]
+	}
+
+	return a
+}
+
+func or16(a, b [16]byte) [16]byte {
+	for i := range a {
+		a[i] |= b[i]
+	}
+
+	return a
+}
+
+func andNot16(a, b [16]byte) [16]byte {
+	for i := range a {
+		a[i] &^= b[i]
+	}
+
+	return a
+}
+
+// increment16 returns a+1, or false if a is the last address of a bits wide address space.
+func increment16(a [16]byte, bits int) ([16]byte, bool) {
+	if a == lowBits(bits) {
+		return a, false
+	}
+
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+
+	return a, true
+}
+
+// decrement16 returns a-1, or false if a is the first address.
+func decrement16(a [16]byte) ([16]byte, bool) {
+	if a == ([16]byte{}) {
+		return a, false
+	}
+
+	for i := 15; i >= 0; i-- {
+		a[i]--
+		if a[i] != 0xff {
+			break
+		}
+	}
+
+	return a, true
+}
@@ -0,0 +1,315 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+// cidrList is a random list of IPv4 and IPv6 entries, clustered in small
+// networks so that overlaps and adjacent ranges are common.
+type cidrList []string
+
+func (cidrList) Generate(rand *rand.Rand, size int) reflect.Value {
+	list := make(cidrList, rand.Intn(size+1))
+
+	for i := range list {
+		if rand.Intn(4) == 0 {
+			ip := net.ParseIP("2001:db8::").To16()
+			ip[14] = byte(rand.Intn(4))
+			ip[15] = byte(rand.Intn(256))
+			list[i] = ip.String() + "/" + strconv.Itoa(112+rand.Intn(17))
+
+			continue
+		}
+
+		ip := net.IPv4(10, 0, byte(rand.Intn(4)), byte(rand.Intn(256))).String()
+		if rand.Intn(3) == 0 {
+			list[i] = ip
+		} else {
+			list[i] = ip + "/" + strconv.Itoa(20+rand.Intn(13))
+		}
+	}
+
+	return reflect.ValueOf(list)
+}
+
+func parseNetworks(t *testing.T, entries []string) []*net.IPNet {
+	t.Helper()
+
+	networks := make([]*net.IPNet, 0, len(entries))
+
+	for _, entry := range entries {
+		r, err := parseIPRange(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, network, err := net.ParseCIDR(formatAddr(r.first, r.ipv6) + "/" + strconv.Itoa(r.bits()-hostBits(r)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func hostBits(r ipRange) int {
+	host := 0
+	for host < r.bits() && or16(r.first, lowBits(host)) != r.last {
+		host++
+	}
+
+	return host
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probes returns addresses at and around the boundaries of every network.
+func probes(networks []*net.IPNet) []net.IP {
+	var ips []net.IP
+
+	for _, network := range networks {
+		ones, _ := network.Mask.Size()
+		r := ipRangeFromIP(network.IP, ones)
+
+		for _, addr := range [][16]byte{r.first, r.last} {
+			ips = append(ips, toIP(addr, r.ipv6))
+
+			if next, ok := increment16(addr, r.bits()); ok {
+				ips = append(ips, toIP(next, r.ipv6))
+			}
+
+			if prev, ok := decrement16(addr); ok {
+				ips = append(ips, toIP(prev, r.ipv6))
+			}
+		}
+	}
+
+	return ips
+}
+
+func toIP(addr [16]byte, ipv6 bool) net.IP {
+	if ipv6 {
+		return net.IP(addr[:])
+	}
+
+	return net.IP(addr[12:])
+}
+
+func TestAggregateSourceRangeCoversSameAddresses(t *testing.T) {
+	property := func(list cidrList) bool {
+		aggregated, err := aggregateSourceRange(list, nil)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+
+		in := parseNetworks(t, list)
+		out := parseNetworks(t, aggregated)
+
+		for _, ip := range append(probes(in), probes(out)...) {
+			if containsIP(in, ip) != containsIP(out, ip) {
+				t.Logf("%s: input %v, aggregated %v", ip, list, aggregated)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateSourceRangeSubtractsExcluded(t *testing.T) {
+	property := func(list, excluded cidrList) bool {
+		aggregated, err := aggregateSourceRange(list, excluded)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+
+		in := parseNetworks(t, list)
+		ex := parseNetworks(t, excluded)
+		out := parseNetworks(t, aggregated)
+
+		for _, ip := range append(append(probes(in), probes(ex)...), probes(out)...) {
+			if (containsIP(in, ip) && !containsIP(ex, ip)) != containsIP(out, ip) {
+				t.Logf("%s: input %v, excluded %v, aggregated %v", ip, list, excluded, aggregated)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateSourceRangeIsMinimal(t *testing.T) {
+	property := func(list, excluded cidrList) bool {
+		aggregated, err := aggregateSourceRange(list, excluded)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+
+		ranges, err := parseIPRanges(aggregated)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+
+		for i := 1; i < len(ranges); i++ {
+			prev, cur := ranges[i-1], ranges[i]
+			if prev.ipv6 != cur.ipv6 {
+				continue
+			}
+
+			if compare16(prev.last, cur.first) >= 0 {
+				t.Logf("overlapping or unsorted entries in %v", aggregated)
+				return false
+			}
+
+			// Two adjacent networks of the same size that form a larger network must be merged.
+			if hostBits(prev) == hostBits(cur) && hostBits(prev) < prev.bits() && and16(prev.first, lowBits(hostBits(prev)+1)) == ([16]byte{}) {
+				if next, ok := increment16(prev.last, prev.bits()); ok && next == cur.first {
+					t.Logf("mergeable entries %s and %s in %v", aggregated[i-1], aggregated[i], aggregated)
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateSourceRangeIsIdempotent(t *testing.T) {
+	property := func(list cidrList) bool {
+		once, err := aggregateSourceRange(list, nil)
+		if err != nil {
+			return false
+		}
+
+		twice, err := aggregateSourceRange(once, nil)
+		if err != nil {
+			return false
+		}
+
+		return reflect.DeepEqual(once, twice)
+	}
+
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAggregateSourceRange(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		entries  []string
+		excluded []string
+		expected []string
+	}{
+		{
+			desc:     "duplicates",
+			entries:  []string{"192.0.2.1", "192.0.2.1/32", "192.0.2.1"},
+			expected: []string{"192.0.2.1/32"},
+		},
+		{
+			desc:     "contained",
+			entries:  []string{"192.168.0.24", "192.168.0.1/24"},
+			expected: []string{"192.168.0.0/24"},
+		},
+		{
+			desc:     "adjacent",
+			entries:  []string{"10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24"},
+			expected: []string{"10.0.0.0/23"},
+		},
+		{
+			desc:     "unaligned",
+			entries:  []string{"10.0.0.1", "10.0.0.2/31", "10.0.0.4/30"},
+			expected: []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30"},
+		},
+		{
+			desc:     "mixed families",
+			entries:  []string{"2001:db8::/33", "192.0.2.0/24", "2001:db8:8000::/33", "::ffff:198.51.100.0/120"},
+			expected: []string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"},
+		},
+		{
+			desc:     "whole address space",
+			entries:  []string{"0.0.0.0/1", "128.0.0.0/1", "::/0"},
+			expected: []string{"0.0.0.0/0", "::/0"},
+		},
+		{
+			desc:     "excluded subnet",
+			entries:  []string{"192.168.0.0/16"},
+			excluded: []string{"192.168.10.0/24"},
+			expected: []string{
+				"192.168.0.0/21", "192.168.8.0/23", "192.168.11.0/24", "192.168.12.0/22",
+				"192.168.16.0/20", "192.168.32.0/19", "192.168.64.0/18", "192.168.128.0/17",
+			},
+		},
+		{
+			desc:     "excluded address",
+			entries:  []string{"10.0.0.0/30", "2001:db8::/127"},
+			excluded: []string{"10.0.0.1", "2001:db8::"},
+			expected: []string{"10.0.0.0/32", "10.0.0.2/31", "2001:db8::1/128"},
+		},
+		{
+			desc:     "excluded superset",
+			entries:  []string{"10.0.0.0/24", "192.0.2.1"},
+			excluded: []string{"10.0.0.0/8", "2001:db8::/32"},
+			expected: []string{"192.0.2.1/32"},
+		},
+		{
+			desc:     "excluded other family",
+			entries:  []string{"::/0"},
+			excluded: []string{"0.0.0.0/0"},
+			expected: []string{"::/0"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			aggregated, err := aggregateSourceRange(test.entries, test.excluded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(aggregated, test.expected) {
+				t.Errorf("got %v, want %v", aggregated, test.expected)
+			}
+		})
+	}
+}
+
+func TestAggregateSourceRangeInvalid(t *testing.T) {
+	for _, entry := range []string{"", "not-an-ip", "192.0.2.1/33", "192.0.2.256"} {
+		if _, err := aggregateSourceRange([]string{entry}, nil); err == nil {
+			t.Errorf("expected an error for %q", entry)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log line.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Log formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger writes leveled log lines with key-value fields, as logfmt text or as JSON objects.
+// Loggers derived with with share the output of their parent.
+type logger struct {
+	level  logLevel
+	json   bool
+	now    func() time.Time
+	out    *logOutput
+	fields []interface{}
+}
+
+// logOutput serializes the lines of all loggers sharing a writer.
+type logOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newLogger returns a logger writing to stderr the lines of level and above, in format.
+// An empty level or format selects info and text.
+func newLogger(level, format string) (*logger, error) {
+	l := &logger{level: levelInfo, now: time.Now, out: &logOutput{w: os.Stderr}}
+
+	if level != "" {
+		found := false
+
+		for candidate, name := range logLevelNames {
+			if strings.EqualFold(level, name) {
+				l.level, found = candidate, true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "", logFormatText:
+	case logFormatJSON:
+		l.json = true
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return l, nil
+}
+
+// Logger is the leveled logger of the provider, for programs that run it outside of Traefik.
+type Logger struct {
+	*logger
+}
+
+// NewLogger returns a logger writing to stderr in the log level and format of config.
+func NewLogger(config *Config) (*Logger, error) {
+	l, err := newLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{l}, nil
+}
+
+// with returns a logger adding the key-value pairs to every line.
+func (l *logger) with(keyValues ...interface{}) *logger {
+	child := *l
+	child.fields = append(append(make([]interface{}, 0, len(l.fields)+len(keyValues)), l.fields...), keyValues...)
+
+	return &child
+}
+
+func (l *logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(levelDebug, msg, keyValues)
+}
+
+func (l *logger) Info(msg string, keyValues ...interface{}) {
+	l.log(levelInfo, msg, keyValues)
+}
+
+func (l *logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(levelWarn, msg, keyValues)
+}
+
+func (l *logger) Error(msg string, keyValues ...interface{}) {
+	l.log(levelError, msg, keyValues)
+}
+
+func (l *logger) log(level logLevel, msg string, keyValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	pairs := append([]interface{}{
+		"time", l.now().UTC().Format(time.RFC3339Nano),
+		"level", logLevelNames[level],
+	}, l.fields...)
+	pairs = append(pairs, "msg", msg)
+	pairs = append(pairs, keyValues...)
+
+	var b bytes.Buffer
+
+	if l.json {
+		writeJSONLine(&b, pairs)
+	} else {
+		writeTextLine(&b, pairs)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	_, _ = l.out.w.Write(b.Bytes())
+}
+
+// writeJSONLine writes the pairs as JSON object, keeping their order.
+func writeJSONLine(b *bytes.Buffer, pairs []interface{}) {
+	b.WriteByte('{')
+
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		b.Write(key)
+		b.WriteByte(':')
+
+		value, err := json.Marshal(logValue(pairValue(pairs, i)))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(pairValue(pairs, i)))
+		}
+
+		b.Write(value)
+	}
+
+	b.WriteString("}\n")
+}
+
+// writeTextLine writes the pairs as logfmt line, quoting values with spaces or special characters.
+func writeTextLine(b *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		value := fmt.Sprint(logValue(pairValue(pairs, i)))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n\\") {
+			value = strconv.Quote(value)
+		}
+
+		fmt.Fprintf(b, "%v=%s", pairs[i], value)
+	}
+
+	b.WriteByte('\n')
+}
+
+// pairValue returns the value of the key at i, or nil for a key without value.
+func pairValue(pairs []interface{}, i int) interface{} {
+	if i+1 < len(pairs) {
+		return pairs[i+1]
+	}
+
+	return nil
+}
+
+// logValue returns errors and values with a String method as strings.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
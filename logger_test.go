@@ -0,0 +1,76 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testLogger(t *testing.T, level, format string) (*logger, *bytes.Buffer) {
+	t.Helper()
+
+	l, err := newLogger(level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	l.out = &logOutput{w: &out}
+	l.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	return l, &out
+}
+
+func TestLoggerText(t *testing.T) {
+	l, out := testLogger(t, "", "")
+
+	l = l.with("provider", "public-whitelist")
+	l.Debug("hidden")
+	l.Info("public IP changed", "address", "192.0.2.1", "previous", "")
+	l.with("middleware", "admin").Error("failed", "error", errors.New(`no "route"`))
+
+	expected := `time=2024-05-01T12:00:00Z level=info provider=public-whitelist msg="public IP changed" address=192.0.2.1 previous=""
+time=2024-05-01T12:00:00Z level=error provider=public-whitelist middleware=admin msg=failed error="no \"route\""
+`
+
+	if out.String() != expected {
+		t.Errorf("got\n%s\nwant\n%s", out, expected)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, out := testLogger(t, "DEBUG", "json")
+
+	l.with("provider", "public-whitelist").Debug("resolved", "address", "192.0.2.1", "cgnat", false, "dangling")
+
+	expected := `{"time":"2024-05-01T12:00:00Z","level":"debug","provider":"public-whitelist","msg":"resolved",` +
+		`"address":"192.0.2.1","cgnat":false,"dangling":null}` + "\n"
+
+	if out.String() != expected {
+		t.Errorf("got\n%s\nwant\n%s", out, expected)
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	l, out := testLogger(t, "warn", "text")
+
+	l.Info("hidden")
+	l.Warn("shown")
+	l.Error("shown")
+
+	if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != 2 {
+		t.Errorf("got %d lines", lines)
+	}
+}
+
+func TestInvalidLoggerConfig(t *testing.T) {
+	if _, err := newLogger("verbose", ""); err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+
+	if _, err := newLogger("", "xml"); err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+}
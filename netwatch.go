@@ -0,0 +1,115 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Route tables of Linux. They are plain files, so reading them works without the syscall package.
+const (
+	procIPv4Route = "/proc/net/route"
+	procIPv6Route = "/proc/net/ipv6_route"
+)
+
+// watchNetworkChanges checks the local network state every networkCheckInterval and requests a refresh
+// as soon as the interface addresses or the default routes change.
+func (p *Provider) watchNetworkChanges(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.networkCheckInterval)
+	defer ticker.Stop()
+
+	last, err := networkFingerprint()
+	if err != nil {
+		p.log.Warn("checking network state failed", "error", err)
+	}
+
+	pending := false
+
+	for {
+		select {
+		case <-ticker.C():
+			fingerprint, err := networkFingerprint()
+			if err != nil {
+				p.log.Warn("checking network state failed", "error", err)
+				continue
+			}
+
+			if fingerprint != last {
+				p.log.Debug("network state changed, refreshing public IPs")
+
+				last = fingerprint
+				pending = true
+			}
+
+			// A rate limited refresh is retried on the next check, so a change is never lost.
+			if pending {
+				accepted, _ := p.refresh.request(p.clock.Now())
+				pending = !accepted
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// networkFingerprint returns a string that changes whenever an interface goes up or down,
+// an interface address changes or a default route changes.
+func networkFingerprint() (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var entries []string
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", err
+		}
+
+		for _, addr := range addrs {
+			entries = append(entries, iface.Name+" "+addr.String())
+		}
+	}
+
+	// The route tables only exist on Linux, elsewhere the interface addresses have to suffice.
+	ipv4Routes, _ := os.ReadFile(procIPv4Route)
+	ipv6Routes, _ := os.ReadFile(procIPv6Route)
+	entries = append(entries, defaultRoutes(string(ipv4Routes), string(ipv6Routes))...)
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, "\n"), nil
+}
+
+// defaultRoutes extracts the interface and gateway of all default routes
+// from the contents of /proc/net/route and /proc/net/ipv6_route.
+func defaultRoutes(ipv4Routes, ipv6Routes string) []string {
+	var routes []string
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	for _, line := range strings.Split(ipv4Routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 8 && fields[1] == "00000000" && fields[7] == "00000000" {
+			routes = append(routes, "route "+fields[0]+" "+fields[2])
+		}
+	}
+
+	// Destination PrefixLength Source SourcePrefixLength NextHop Metric RefCnt Use Flags Iface
+	for _, line := range strings.Split(ipv6Routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 10 && strings.Trim(fields[0], "0") == "" && fields[1] == "00" && strings.Trim(fields[4], "0") != "" {
+			routes = append(routes, "route6 "+fields[9]+" "+fields[4])
+		}
+	}
+
+	return routes
+}
@@ -0,0 +1,44 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultRoutes(t *testing.T) {
+	ipv4Routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+
+	ipv6Routes := `20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+`
+
+	expected := []string{
+		"route eth0 0100A8C0",
+		"route6 eth0 fe800000000000000000000000000001",
+	}
+
+	routes := defaultRoutes(ipv4Routes, ipv6Routes)
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("got %v, want %v", routes, expected)
+	}
+}
+
+func TestNetworkFingerprintIsStable(t *testing.T) {
+	first, err := networkFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := networkFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Errorf("fingerprint changed without a network change:\n%s\n---\n%s", first, second)
+	}
+}
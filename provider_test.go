@@ -0,0 +1,816 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/traefik/genconf/dynamic"
+)
+
+// fakeClock is a clock whose time only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.newWaiter(d, d)}
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.newWaiter(d, 0)
+}
+
+func (c *fakeClock) newWaiter(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{clock: c, ch: make(chan time.Time, 1), next: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, w)
+
+	return w
+}
+
+// Advance moves the time forward by d and fires the tickers and timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	active := c.waiters[:0]
+
+	for _, w := range c.waiters {
+		if w.stopped {
+			continue
+		}
+
+		if !w.next.After(c.now) {
+			// Like the tickers of the time package, ticks are dropped while the receiver is behind.
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+
+			if w.period == 0 {
+				w.stopped = true
+				continue
+			}
+
+			for !w.next.After(c.now) {
+				w.next = w.next.Add(w.period)
+			}
+		}
+
+		active = append(active, w)
+	}
+
+	c.waiters = active
+}
+
+// fakeWaiter is a ticker of a fakeClock, or a timer if its period is 0.
+type fakeWaiter struct {
+	clock   *fakeClock
+	ch      chan time.Time
+	next    time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	w.next = w.clock.now.Add(d)
+	w.period = d
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	wasActive := !w.stopped
+	w.stopped = true
+
+	return wasActive
+}
+
+// fakeTicker adapts the Stop method of a fakeWaiter to the ticker interface.
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
+
+// fakeResolver returns the scripted answers in order, the last one is repeated.
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers []fakeAnswer
+	calls   int
+}
+
+type fakeAnswer struct {
+	ip  string
+	err error
+}
+
+func (r *fakeResolver) resolve(context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	answer := r.answers[len(r.answers)-1]
+	if r.calls < len(r.answers) {
+		answer = r.answers[r.calls]
+	}
+
+	r.calls++
+
+	return answer.ip, answer.err
+}
+
+// blockingResolver blocks every resolution until release is closed or, unless it ignores the context, ctx is done.
+// The first free resolutions are answered right away.
+type blockingResolver struct {
+	started       chan struct{}
+	release       chan struct{}
+	ignoreContext bool
+
+	mu   sync.Mutex
+	free int
+}
+
+func (r *blockingResolver) resolve(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	free := r.free > 0
+	r.free--
+	r.mu.Unlock()
+
+	if free {
+		return "192.0.2.1", nil
+	}
+
+	notify(r.started)
+
+	if r.ignoreContext {
+		<-r.release
+		return "192.0.2.1", nil
+	}
+
+	select {
+	case <-r.release:
+		return "192.0.2.1", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+var errResolver = errors.New("resolver unavailable")
+
+func startProvider(t *testing.T, config *Config, options ...option) (*Provider, chan json.Marshaler) {
+	t.Helper()
+
+	p, err := newProvider(context.Background(), config, "test", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfgChan := make(chan json.Marshaler)
+
+	if err = p.Provide(cfgChan); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := p.Stop(); err != nil {
+			t.Error(err)
+		}
+
+	})
+
+	return p, cfgChan
+}
+
+// testConfig returns the default configuration, but accepts the documentation addresses used by the tests.
+func testConfig() *Config {
+	config := CreateConfig()
+	config.BogonPolicy = bogonPolicyAllow
+
+	return config
+}
+
+func nextSourceRange(t *testing.T, cfgChan <-chan json.Marshaler) []string {
+	t.Helper()
+
+	select {
+	case data := <-cfgChan:
+		configuration := data.(*dynamic.JSONPayload).Configuration
+		return configuration.HTTP.Middlewares[whitelistMiddleware].IPWhiteList.SourceRange
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("no configuration was published")
+		return nil
+	}
+}
+
+func expectNoConfiguration(t *testing.T, cfgChan <-chan json.Marshaler) {
+	t.Helper()
+
+	select {
+	case data := <-cfgChan:
+		t.Fatalf("unexpected configuration %+v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPollPublishesIPChanges(t *testing.T) {
+	config := testConfig()
+	config.WhitelistIPv6 = true
+
+	clock := newFakeClock()
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}, {ip: "192.0.2.1"}, {ip: "192.0.2.2"}}}
+	ipv6 := &fakeResolver{answers: []fakeAnswer{{ip: "2001:db8:1::1"}, {ip: "2001:db8:2::1"}}}
+
+	_, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv6))
+
+	expected := [][]string{
+		{"192.0.2.1/32", "2001:db8:1::/64"},
+		{"192.0.2.1/32", "2001:db8:2::/64"},
+		{"192.0.2.2/32", "2001:db8:2::/64"},
+	}
+
+	for i, want := range expected {
+		if i > 0 {
+			expectNoConfiguration(t, cfgChan)
+			clock.Advance(300 * time.Second)
+		}
+
+		if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+			t.Errorf("poll %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestResolveFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		answers  []fakeAnswer
+		expected [][]string
+	}{
+		{
+			policy:  resolveFailureKeep,
+			answers: []fakeAnswer{{ip: "192.0.2.1"}, {err: errResolver}, {ip: "192.0.2.2"}},
+			expected: [][]string{
+				{"10.0.0.0/8", "192.0.2.1/32"},
+				{"10.0.0.0/8", "192.0.2.1/32"},
+				{"10.0.0.0/8", "192.0.2.2/32"},
+			},
+		},
+		{
+			policy:  resolveFailureRemove,
+			answers: []fakeAnswer{{ip: "192.0.2.1"}, {err: errResolver}, {ip: "192.0.2.2"}},
+			expected: [][]string{
+				{"10.0.0.0/8", "192.0.2.1/32"},
+				{"10.0.0.0/8"},
+				{"10.0.0.0/8", "192.0.2.2/32"},
+			},
+		},
+		{
+			policy:  resolveFailureKeep,
+			answers: []fakeAnswer{{err: errResolver}, {ip: "not an IP"}, {ip: "192.0.2.1"}},
+			expected: [][]string{
+				{"10.0.0.0/8"},
+				{"10.0.0.0/8"},
+				{"10.0.0.0/8", "192.0.2.1/32"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.policy, func(t *testing.T) {
+			config := testConfig()
+			config.AdditionalSourceRange = []string{"10.0.0.0/8"}
+			config.OnResolveFailure = test.policy
+
+			clock := newFakeClock()
+			ipv4 := &fakeResolver{answers: test.answers}
+
+			_, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv4))
+
+			for i, want := range test.expected {
+				if i > 0 {
+					clock.Advance(300 * time.Second)
+				}
+
+				if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+					t.Errorf("poll %d: got %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidResolveFailurePolicy(t *testing.T) {
+	config := testConfig()
+	config.OnResolveFailure = "ignore"
+
+	if _, err := New(context.Background(), config, "test"); err == nil {
+		t.Fatal("expected an error for an invalid resolve failure policy")
+	}
+}
+
+func TestRefreshResetsPollInterval(t *testing.T) {
+	config := testConfig()
+
+	clock := newFakeClock()
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}, {ip: "192.0.2.2"}, {ip: "192.0.2.3"}}}
+
+	p, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv4))
+	nextSourceRange(t, cfgChan)
+
+	clock.Advance(200 * time.Second)
+
+	if ok, _ := p.refresh.request(clock.Now()); !ok {
+		t.Fatal("refresh was rejected")
+	}
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.2/32"}) {
+		t.Errorf("refresh: got %v", got)
+	}
+
+	// The next poll is due a full interval after the refresh.
+	clock.Advance(100 * time.Second)
+	expectNoConfiguration(t, cfgChan)
+
+	clock.Advance(200 * time.Second)
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.3/32"}) {
+		t.Errorf("poll: got %v", got)
+	}
+}
+
+func TestStopRacesWithPolls(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		config := testConfig()
+
+		clock := newFakeClock()
+		ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}}}
+
+		p, err := newProvider(context.Background(), config, "test", withClock(clock), withResolvers(ipv4, ipv4))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfgChan := make(chan json.Marshaler, 100)
+
+		if err = p.Provide(cfgChan); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				clock.Advance(300 * time.Second)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				notify(p.regenerate)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			if err := p.Stop(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		wg.Wait()
+
+		select {
+		case <-p.done:
+		default:
+			t.Fatal("Stop returned before the poll loop")
+		}
+
+		// Nothing is published once the loop has returned.
+		published := len(cfgChan)
+		clock.Advance(300 * time.Second)
+		notify(p.regenerate)
+
+		if len(cfgChan) != published {
+			t.Fatal("a configuration was published after Stop")
+		}
+	}
+}
+
+func TestStopWhileResolving(t *testing.T) {
+	config := testConfig()
+
+	ipv4 := &blockingResolver{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(ipv4.release)
+
+	p, err := newProvider(context.Background(), config, "test", withClock(newFakeClock()), withResolvers(ipv4, ipv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgChan := make(chan json.Marshaler, 1)
+
+	if err = p.Provide(cfgChan); err != nil {
+		t.Fatal(err)
+	}
+
+	<-ipv4.started
+
+	// The resolution is cancelled, so Stop doesn't have to wait for it.
+	if err = p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfgChan) != 0 {
+		t.Error("a configuration was published after a cancelled resolution")
+	}
+}
+
+func TestGrantExpiresWhileResolving(t *testing.T) {
+	config := testConfig()
+
+	clock := newFakeClock()
+	ipv4 := &blockingResolver{started: make(chan struct{}, 1), release: make(chan struct{}), free: 1}
+
+	p, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv4))
+
+	if got, want := nextSourceRange(t, cfgChan), []string{"192.0.2.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	p.grants.add(grant{SourceRange: "203.0.113.7/32", Middleware: whitelistMiddleware, Expires: clock.Now().Add(12 * time.Minute)})
+	notify(p.regenerate)
+
+	if got, want := nextSourceRange(t, cfgChan), []string{"192.0.2.1/32", "203.0.113.7/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with the grant: got %v, want %v", got, want)
+	}
+
+	// The resolution hangs past the next poll, nothing changes until the grant expires.
+	clock.Advance(5 * time.Minute)
+	<-ipv4.started
+	clock.Advance(5 * time.Minute)
+	expectNoConfiguration(t, cfgChan)
+
+	clock.Advance(5 * time.Minute)
+
+	if got, want := nextSourceRange(t, cfgChan), []string{"192.0.2.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after the expiry: got %v, want %v", got, want)
+	}
+
+	// The hanging resolution is published once it answers.
+	close(ipv4.release)
+
+	if got, want := nextSourceRange(t, cfgChan), []string{"192.0.2.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after the resolution: got %v, want %v", got, want)
+	}
+}
+
+func TestStopTimesOut(t *testing.T) {
+	config := testConfig()
+
+	ipv4 := &blockingResolver{started: make(chan struct{}, 1), release: make(chan struct{}), ignoreContext: true}
+	defer close(ipv4.release)
+
+	p, err := newProvider(context.Background(), config, "test", withClock(newFakeClock()), withResolvers(ipv4, ipv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.stopTimeout = 10 * time.Millisecond
+
+	if err = p.Provide(make(chan json.Marshaler)); err != nil {
+		t.Fatal(err)
+	}
+
+	<-ipv4.started
+
+	if err = p.Stop(); err == nil {
+		t.Fatal("expected an error for a resolution that ignores the cancellation")
+	}
+}
+
+func TestStopWithoutReceiver(t *testing.T) {
+	config := testConfig()
+
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}}}
+
+	p, err := newProvider(context.Background(), config, "test", withClock(newFakeClock()), withResolvers(ipv4, ipv4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody receives from the channel, like after Traefik stopped reading it.
+	if err = p.Provide(make(chan json.Marshaler)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopBeforeProvide(t *testing.T) {
+	p, err := New(context.Background(), CreateConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rendezvousResolver only answers once its partner was called as well, so it fails unless both resolve concurrently.
+type rendezvousResolver struct {
+	ip      string
+	arrived chan struct{}
+	partner chan struct{}
+}
+
+func (r *rendezvousResolver) resolve(context.Context) (string, error) {
+	close(r.arrived)
+
+	select {
+	case <-r.partner:
+		return r.ip, nil
+	case <-time.After(time.Second):
+		return "", errResolver
+	}
+}
+
+func TestFamiliesAreResolvedConcurrently(t *testing.T) {
+	config := testConfig()
+	config.WhitelistIPv6 = true
+
+	v4Arrived, v6Arrived := make(chan struct{}), make(chan struct{})
+	ipv4 := &rendezvousResolver{ip: "192.0.2.1", arrived: v4Arrived, partner: v6Arrived}
+	ipv6 := &rendezvousResolver{ip: "2001:db8::1", arrived: v6Arrived, partner: v4Arrived}
+
+	_, cfgChan := startProvider(t, config, withClock(newFakeClock()), withResolvers(ipv4, ipv6))
+
+	want := []string{"192.0.2.1/32", "2001:db8::/64"}
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFamiliesFailIndependently(t *testing.T) {
+	config := testConfig()
+	config.WhitelistIPv6 = true
+
+	clock := newFakeClock()
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{err: errResolver}, {ip: "192.0.2.1"}, {err: errResolver}}}
+	ipv6 := &fakeResolver{answers: []fakeAnswer{{ip: "2001:db8:1::1"}, {err: errResolver}, {ip: "2001:db8:2::1"}}}
+
+	_, cfgChan := startProvider(t, config, withClock(clock), withResolvers(ipv4, ipv6))
+
+	expected := [][]string{
+		{"2001:db8:1::/64"},
+		{"192.0.2.1/32", "2001:db8:1::/64"},
+		{"192.0.2.1/32", "2001:db8:2::/64"},
+	}
+
+	for i, want := range expected {
+		if i > 0 {
+			clock.Advance(300 * time.Second)
+		}
+
+		if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+			t.Errorf("poll %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	config := testConfig()
+	config.WhitelistIPv4 = false
+	config.WhitelistIPv6 = true
+
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}}}
+	ipv6 := &fakeResolver{answers: []fakeAnswer{{ip: "2001:db8::1"}}}
+
+	_, cfgChan := startProvider(t, config, withClock(newFakeClock()), withResolvers(ipv4, ipv6))
+
+	want := []string{"2001:db8::/64"}
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ipv4.mu.Lock()
+	defer ipv4.mu.Unlock()
+
+	if ipv4.calls != 0 {
+		t.Errorf("the IPv4 resolver was called %d times", ipv4.calls)
+	}
+}
+
+func TestHTTPResolverFamilies(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("dual-stack listening is not available: %v", err)
+	}
+
+	// Like a generic "what is my IP" service, the server answers with the address of the caller.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprint(w, host)
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	ipv4URL := fmt.Sprintf("http://127.0.0.1:%d", port)
+	ipv6URL := fmt.Sprintf("http://[::1]:%d", port)
+
+	tests := []struct {
+		url      string
+		network  string
+		expected string
+	}{
+		{url: ipv4URL, network: "tcp4", expected: "127.0.0.1"},
+		{url: ipv6URL, network: "tcp6", expected: "::1"},
+		// The resolvers never fall back to the other family.
+		{url: ipv6URL, network: "tcp4"},
+		{url: ipv4URL, network: "tcp6"},
+	}
+
+	for _, test := range tests {
+		ip, err := newHTTPResolver(test.url, test.network, nil).resolve(context.Background())
+
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s over %s: expected an error, got %s", test.url, test.network, ip)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s over %s: %v", test.url, test.network, err)
+		} else if ip != test.expected {
+			t.Errorf("%s over %s: got %s, want %s", test.url, test.network, ip, test.expected)
+		}
+	}
+}
+
+func TestResolverFamilyMismatch(t *testing.T) {
+	config := testConfig()
+
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{ip: "2001:db8::1"}}}
+	ipv6 := &fakeResolver{answers: []fakeAnswer{{ip: "192.0.2.1"}}}
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = p.resolveIPv4(context.Background(), ipv4); err == nil {
+		t.Error("an IPv6 address was accepted as IPv4 address")
+	}
+
+	if _, err = p.resolveIPv6CIDR(context.Background(), ipv6); err == nil {
+		t.Error("an IPv4 address was accepted as IPv6 address")
+	}
+}
+
+func TestResolveFailureIsLoggedOnce(t *testing.T) {
+	config := testConfig()
+	config.LogFormat = logFormatJSON
+
+	var out bytes.Buffer
+
+	ipv4 := &fakeResolver{answers: []fakeAnswer{{err: errResolver}}}
+
+	_, cfgChan := startProvider(t, config, withClock(newFakeClock()), withResolvers(ipv4, ipv4), withLogOutput(&out))
+
+	nextSourceRange(t, cfgChan)
+
+	var lines []map[string]interface{}
+
+	decoder := json.NewDecoder(&out)
+
+	for decoder.More() {
+		var line map[string]interface{}
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines: %v", len(lines), lines)
+	}
+
+	expected := map[string]interface{}{
+		"level":    "error",
+		"provider": "test",
+		"msg":      "resolving public IP failed",
+		"family":   "IPv4",
+		"error":    errResolver.Error(),
+	}
+
+	for key, value := range expected {
+		if lines[0][key] != value {
+			t.Errorf("%s: got %v, want %v", key, lines[0][key], value)
+		}
+	}
+}
+
+func TestFailingWhitelistKeepsItsSourceRange(t *testing.T) {
+	config := testConfig()
+	config.GeoIPDatabase = "/nonexistent.mmdb"
+	config.Whitelists = map[string]WhitelistConfig{"eu": {Countries: []string{"DE"}}}
+
+	p, err := newProvider(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := generationInputs{
+		now:         time.Now(),
+		ipAddresses: wanAddresses{defaultWAN: {v4: "192.0.2.1"}},
+		countries:   map[string][]string{"DE": {"invalid"}},
+	}
+
+	// A whitelist that was never published is left out, the others are generated as usual.
+	configuration, failed, err := generateConfiguration(p, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failed) != 1 || failed[0].middleware != "eu" {
+		t.Fatalf("got failures %v", failed)
+	}
+
+	if _, ok := whitelistSourceRange(configuration, "eu"); ok {
+		t.Error("the failed whitelist was generated")
+	}
+
+	if got, _ := whitelistSourceRange(configuration, whitelistMiddleware); !reflect.DeepEqual(got, []string{"192.0.2.1/32"}) {
+		t.Errorf("got %v", got)
+	}
+
+	inputs.published = map[string][]string{"eu": {"198.51.100.0/24"}}
+
+	configuration, _, err = generateConfiguration(p, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := whitelistSourceRange(configuration, "eu"); !reflect.DeepEqual(got, []string{"198.51.100.0/24"}) {
+		t.Errorf("got %v, want the published source range", got)
+	}
+}
@@ -0,0 +1,219 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/traefik/genconf/dynamic"
+	"github.com/traefik/genconf/dynamic/types"
+)
+
+// RouteConfig a route protected by the whitelist.
+// A router is generated for every route, together with a load balancer service for its servers.
+type RouteConfig struct {
+	Rule           string                   `json:"rule,omitempty"`
+	EntryPoints    []string                 `json:"entryPoints,omitempty"`
+	Priority       int                      `json:"priority,omitempty"`
+	Servers        []string                 `json:"servers,omitempty"`
+	Service        string                   `json:"service,omitempty"`
+	PassHostHeader *bool                    `json:"passHostHeader,omitempty"`
+	TLS            *dynamic.RouterTLSConfig `json:"tls,omitempty"`
+	Middleware     string                   `json:"middleware,omitempty"`
+}
+
+// validateRoutes checks routes, middlewares holds the names of all middlewares a route may use.
+func validateRoutes(routes map[string]RouteConfig, middlewares map[string]bool) error {
+	for name, route := range routes {
+		if route.Middleware != "" && !middlewares[route.Middleware] {
+			return fmt.Errorf("route %q: unknown middleware %q", name, route.Middleware)
+		}
+
+		if route.Rule == "" {
+			return fmt.Errorf("route %q: rule is required", name)
+		}
+
+		if len(route.Servers) == 0 && route.Service == "" {
+			return fmt.Errorf("route %q: either servers or service is required", name)
+		}
+
+		if len(route.Servers) > 0 && route.Service != "" {
+			return fmt.Errorf("route %q: servers and service are mutually exclusive", name)
+		}
+
+		for _, server := range route.Servers {
+			if u, err := url.Parse(server); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("route %q: invalid server URL %q", name, server)
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyRoutes(routes map[string]RouteConfig) map[string]RouteConfig {
+	copied := make(map[string]RouteConfig, len(routes))
+
+	for name, route := range routes {
+		route.EntryPoints = copyStrings(route.EntryPoints)
+		route.Servers = copyStrings(route.Servers)
+
+		if route.PassHostHeader != nil {
+			passHostHeader := *route.PassHostHeader
+			route.PassHostHeader = &passHostHeader
+		}
+
+		route.TLS = copyRouterTLS(route.TLS)
+		copied[name] = route
+	}
+
+	return copied
+}
+
+// routeFallback splits every route that doesn't choose a middleware into two routers, so whitelisted IPs skip
+// authentication while everyone else has to authenticate. A chain can't express this, it always applies all of its parts.
+type routeFallback struct {
+	whitelisted   string   // The middleware of requests from sourceRange.
+	authenticated string   // The middleware of all other requests.
+	sourceRange   []string // The whitelisted networks, matched by the rule of the router of whitelisted requests.
+}
+
+// maxFallbackMatchers is the largest number of ClientIP matchers in the rule of a whitelisted router.
+const maxFallbackMatchers = 100
+
+// newRouteFallback returns the fallback of the chain of provider for the whitelist of configuration.
+// A source range beyond maxFallbackMatchers is logged and left out, so every IP has to authenticate.
+func newRouteFallback(provider *Provider, configuration *dynamic.Configuration) *routeFallback {
+	fallback := &routeFallback{
+		whitelisted:   provider.chain.whitelistedName(),
+		authenticated: provider.chain.authenticatedName(),
+	}
+
+	sourceRange, _ := whitelistSourceRange(configuration, whitelistMiddleware)
+	if len(sourceRange) > maxFallbackMatchers {
+		provider.log.with("middleware", fallback.whitelisted).Error("too many whitelisted networks for authFallback, all IPs have to authenticate",
+			"networks", len(sourceRange), "limit", maxFallbackMatchers)
+
+		return fallback
+	}
+
+	fallback.sourceRange = sourceRange
+
+	return fallback
+}
+
+// whitelistedRouter returns the router of router's requests from the whitelisted networks, or nil if there are none.
+// Its rule is longer, or its priority higher if one is set, so Traefik tries it first.
+func (f *routeFallback) whitelistedRouter(router *dynamic.Router) *dynamic.Router {
+	if len(f.sourceRange) == 0 {
+		return nil
+	}
+
+	matchers := make([]string, 0, len(f.sourceRange))
+	for _, sourceRange := range f.sourceRange {
+		matchers = append(matchers, "ClientIP(`"+sourceRange+"`)")
+	}
+
+	whitelisted := *router
+	whitelisted.EntryPoints = copyStrings(router.EntryPoints)
+	whitelisted.TLS = copyRouterTLS(router.TLS)
+	whitelisted.Rule = "(" + router.Rule + ") && (" + strings.Join(matchers, " || ") + ")"
+	whitelisted.Middlewares = []string{f.whitelisted}
+
+	if whitelisted.Priority > 0 {
+		whitelisted.Priority++
+	}
+
+	return &whitelisted
+}
+
+// validateFallbackRoutes checks that the additional routers of the routes split by a routeFallback don't
+// collide with other routes.
+func validateFallbackRoutes(routes map[string]RouteConfig) error {
+	for name, route := range routes {
+		if _, ok := routes[name+whitelistedRouterSuffix]; ok && route.Middleware == "" {
+			return fmt.Errorf("route %q: name is used by the whitelisted router of route %q", name+whitelistedRouterSuffix, name)
+		}
+	}
+
+	return nil
+}
+
+// whitelistedRouterSuffix is appended to the name of a route for the router of its whitelisted requests.
+const whitelistedRouterSuffix = "-whitelisted"
+
+// addRoutes adds a router for every route to configuration, and a service for every route that defines its own servers.
+// Routes that don't choose a middleware are protected by middleware, or split by fallback if it isn't nil.
+func addRoutes(configuration *dynamic.Configuration, routes map[string]RouteConfig, middleware string, fallback *routeFallback) {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		route := routes[name]
+
+		protection := middleware
+		if route.Middleware != "" {
+			protection = route.Middleware
+		}
+
+		router := &dynamic.Router{
+			EntryPoints: copyStrings(route.EntryPoints),
+			Middlewares: []string{protection},
+			Service:     route.Service,
+			Rule:        route.Rule,
+			Priority:    route.Priority,
+			TLS:         copyRouterTLS(route.TLS),
+		}
+
+		if len(route.Servers) > 0 {
+			router.Service = name
+
+			loadBalancer := &dynamic.ServersLoadBalancer{PassHostHeader: boolPtr(true)}
+			if route.PassHostHeader != nil {
+				loadBalancer.PassHostHeader = boolPtr(*route.PassHostHeader)
+			}
+
+			for _, server := range route.Servers {
+				loadBalancer.Servers = append(loadBalancer.Servers, dynamic.Server{URL: server})
+			}
+
+			configuration.HTTP.Services[name] = &dynamic.Service{LoadBalancer: loadBalancer}
+		}
+
+		if fallback != nil && route.Middleware == "" {
+			router.Middlewares = []string{fallback.authenticated}
+
+			if whitelisted := fallback.whitelistedRouter(router); whitelisted != nil {
+				configuration.HTTP.Routers[name+whitelistedRouterSuffix] = whitelisted
+			}
+		}
+
+		configuration.HTTP.Routers[name] = router
+	}
+}
+
+func copyRouterTLS(tlsConfig *dynamic.RouterTLSConfig) *dynamic.RouterTLSConfig {
+	if tlsConfig == nil {
+		return nil
+	}
+
+	copied := &dynamic.RouterTLSConfig{
+		Options:      tlsConfig.Options,
+		CertResolver: tlsConfig.CertResolver,
+	}
+
+	for _, domain := range tlsConfig.Domains {
+		copied.Domains = append(copied.Domains, types.Domain{Main: domain.Main, SANs: copyStrings(domain.SANs)})
+	}
+
+	return copied
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
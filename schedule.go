@@ -0,0 +1,243 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig source ranges that are only whitelisted within weekly time windows.
+type ScheduleConfig struct {
+	SourceRange []string `json:"sourceRange,omitempty"`
+	Middleware  string   `json:"middleware,omitempty"`
+	Days        []string `json:"days,omitempty"`
+	Start       string   `json:"start,omitempty"`
+	End         string   `json:"end,omitempty"`
+	TimeZone    string   `json:"timeZone,omitempty"`
+}
+
+// schedule the settings of a schedule.
+// A window opens at start on every day of days and closes at end, on the next day if end is not after start.
+type schedule struct {
+	sourceRange []string
+	middleware  string
+	days        [7]bool
+	start       time.Duration
+	end         time.Duration
+	location    *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func newSchedules(configs []ScheduleConfig, whitelists []whitelist) ([]schedule, error) {
+	schedules := make([]schedule, 0, len(configs))
+
+	for i, config := range configs {
+		s, err := newSchedule(config, whitelists)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %w", i, err)
+		}
+
+		schedules = append(schedules, s)
+	}
+
+	return schedules, nil
+}
+
+func newSchedule(config ScheduleConfig, whitelists []whitelist) (schedule, error) {
+	if len(config.SourceRange) == 0 {
+		return schedule{}, fmt.Errorf("source range is required")
+	}
+
+	if _, err := parseIPRanges(config.SourceRange); err != nil {
+		return schedule{}, err
+	}
+
+	s := schedule{
+		sourceRange: copyStrings(config.SourceRange),
+		middleware:  config.Middleware,
+	}
+
+	if s.middleware == "" {
+		s.middleware = whitelistMiddleware
+	}
+
+	if !containsWhitelist(whitelists, s.middleware) {
+		return schedule{}, fmt.Errorf("unknown whitelist middleware %q", s.middleware)
+	}
+
+	if len(config.Days) == 0 {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+
+	for _, days := range config.Days {
+		if err := s.addDays(days); err != nil {
+			return schedule{}, err
+		}
+	}
+
+	var err error
+
+	if s.start, err = parseTimeOfDay(config.Start, "00:00"); err != nil {
+		return schedule{}, err
+	}
+
+	if s.end, err = parseTimeOfDay(config.End, "24:00"); err != nil {
+		return schedule{}, err
+	}
+
+	timeZone := config.TimeZone
+	if timeZone == "" {
+		timeZone = "Local"
+	}
+
+	if s.location, err = time.LoadLocation(timeZone); err != nil {
+		return schedule{}, err
+	}
+
+	return s, nil
+}
+
+// addDays enables a single day like "Mon" or a range of days like "Mon-Fri".
+func (s *schedule) addDays(days string) error {
+	bounds := strings.SplitN(strings.ToLower(strings.TrimSpace(days)), "-", 2)
+
+	first, ok := weekdays[strings.TrimSpace(bounds[0])]
+	if !ok {
+		return fmt.Errorf("invalid day %q", days)
+	}
+
+	last := first
+	if len(bounds) == 2 {
+		if last, ok = weekdays[strings.TrimSpace(bounds[1])]; !ok {
+			return fmt.Errorf("invalid day %q", days)
+		}
+	}
+
+	for day := first; ; day = (day + 1) % 7 {
+		s.days[day] = true
+
+		if day == last {
+			return nil
+		}
+	}
+}
+
+// parseTimeOfDay parses "HH:MM" into the duration since midnight, "24:00" is the end of the day.
+func parseTimeOfDay(value, fallback string) (time.Duration, error) {
+	if value == "" {
+		value = fallback
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// window returns the window opening on the day of date. The clock times are applied in the schedule's
+// time zone, so windows follow daylight saving time changes.
+func (s schedule) window(date time.Time) (time.Time, time.Time) {
+	year, month, day := date.Date()
+
+	start := time.Date(year, month, day, 0, int(s.start/time.Minute), 0, 0, s.location)
+
+	endDay := day
+	if s.end <= s.start {
+		endDay++
+	}
+
+	end := time.Date(year, month, endDay, 0, int(s.end/time.Minute), 0, 0, s.location)
+
+	return start, end
+}
+
+// active reports whether now is within a window of the schedule.
+func (s schedule) active(now time.Time) bool {
+	local := now.In(s.location)
+
+	// A window that opened yesterday may still be open.
+	for offset := -1; offset <= 0; offset++ {
+		date := local.AddDate(0, 0, offset)
+		if !s.days[date.Weekday()] {
+			continue
+		}
+
+		start, end := s.window(date)
+		if !now.Before(start) && now.Before(end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextBoundary returns the next time after now at which a window of the schedule opens or closes.
+func (s schedule) nextBoundary(now time.Time) time.Time {
+	local := now.In(s.location)
+
+	var next time.Time
+
+	for offset := -1; offset <= 7; offset++ {
+		date := local.AddDate(0, 0, offset)
+		if !s.days[date.Weekday()] {
+			continue
+		}
+
+		start, end := s.window(date)
+		for _, boundary := range []time.Time{start, end} {
+			if boundary.After(now) {
+				next = earliest(next, boundary)
+			}
+		}
+	}
+
+	return next
+}
+
+// scheduledSourceRanges returns the source ranges of the schedules for middleware that are active at now.
+func scheduledSourceRanges(schedules []schedule, middleware string, now time.Time) []string {
+	var sourceRange []string
+
+	for _, s := range schedules {
+		if s.middleware == middleware && s.active(now) {
+			sourceRange = append(sourceRange, s.sourceRange...)
+		}
+	}
+
+	return sourceRange
+}
+
+// nextScheduleBoundary returns the next time after now at which any schedule changes, or the zero time.
+func nextScheduleBoundary(schedules []schedule, now time.Time) time.Time {
+	var next time.Time
+
+	for _, s := range schedules {
+		next = earliest(next, s.nextBoundary(now))
+	}
+
+	return next
+}
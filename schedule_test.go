@@ -0,0 +1,89 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	whitelists := []whitelist{{name: whitelistMiddleware}}
+
+	businessHours, err := newSchedule(ScheduleConfig{
+		SourceRange: []string{"198.51.100.0/24"},
+		Days:        []string{"Mon-Fri"},
+		Start:       "08:00",
+		End:         "18:00",
+		TimeZone:    "Europe/Berlin",
+	}, whitelists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overnight, err := newSchedule(ScheduleConfig{
+		SourceRange: []string{"203.0.113.0/24"},
+		Days:        []string{"Sat"},
+		Start:       "22:00",
+		End:         "02:00",
+		TimeZone:    "Europe/Berlin",
+	}, whitelists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(day, hour, minute int) time.Time {
+		// October 2026: the 12th is a Monday, daylight saving time ends on the 25th.
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, berlin)
+	}
+
+	testCases := []struct {
+		desc         string
+		schedule     schedule
+		now          time.Time
+		active       bool
+		nextBoundary time.Time
+	}{
+		{desc: "before opening", schedule: businessHours, now: at(12, 7, 59), active: false, nextBoundary: at(12, 8, 0)},
+		{desc: "opening", schedule: businessHours, now: at(12, 8, 0), active: true, nextBoundary: at(12, 18, 0)},
+		{desc: "closing", schedule: businessHours, now: at(16, 18, 0), active: false, nextBoundary: at(19, 8, 0)},
+		{desc: "weekend", schedule: businessHours, now: at(17, 12, 0), active: false, nextBoundary: at(19, 8, 0)},
+		{desc: "other time zone", schedule: businessHours, now: time.Date(2026, time.October, 12, 6, 30, 0, 0, time.UTC), active: true, nextBoundary: at(12, 18, 0)},
+		{desc: "overnight before", schedule: overnight, now: at(17, 21, 0), active: false, nextBoundary: at(17, 22, 0)},
+		{desc: "overnight after midnight", schedule: overnight, now: at(18, 1, 0), active: true, nextBoundary: at(18, 2, 0)},
+		{desc: "overnight over", schedule: overnight, now: at(18, 2, 0), active: false, nextBoundary: at(24, 22, 0)},
+		{desc: "daylight saving time", schedule: overnight, now: at(24, 23, 0), active: true, nextBoundary: at(25, 2, 0)},
+	}
+
+	for _, test := range testCases {
+		if active := test.schedule.active(test.now); active != test.active {
+			t.Errorf("%s: got active %t, want %t", test.desc, active, test.active)
+		}
+
+		if next := test.schedule.nextBoundary(test.now); !next.Equal(test.nextBoundary) {
+			t.Errorf("%s: got next boundary %s, want %s", test.desc, next, test.nextBoundary)
+		}
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	whitelists := []whitelist{{name: whitelistMiddleware}}
+
+	for _, config := range []ScheduleConfig{
+		{},
+		{Days: []string{"Mon-Fri"}, Start: "08:00", End: "18:00"},
+		{SourceRange: []string{"not-an-ip"}},
+		{SourceRange: []string{"192.0.2.1"}, Days: []string{"Someday"}},
+		{SourceRange: []string{"192.0.2.1"}, Start: "25:00"},
+		{SourceRange: []string{"192.0.2.1"}, End: "8"},
+		{SourceRange: []string{"192.0.2.1"}, TimeZone: "Nowhere/Special"},
+		{SourceRange: []string{"192.0.2.1"}, Middleware: "unknown"},
+	} {
+		if _, err := newSchedule(config, whitelists); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
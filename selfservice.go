@@ -0,0 +1,386 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// grantOriginSelfService is the origin of grants added through the self-service endpoint.
+const grantOriginSelfService = "self-service"
+
+// SelfServiceConfig the self-service endpoint, that lets a caller with a valid token whitelist its own IP.
+type SelfServiceConfig struct {
+	Address    string   `json:"address,omitempty"`
+	Tokens     []string `json:"tokens,omitempty"`
+	TOTPSecret string   `json:"totpSecret,omitempty"`
+	Duration   string   `json:"duration,omitempty"`
+	Middleware string   `json:"middleware,omitempty"`
+	Depth      int      `json:"depth,omitempty"`
+}
+
+// selfService the settings of the self-service endpoint.
+type selfService struct {
+	address    string
+	tokens     []string
+	totpSecret []byte
+	duration   time.Duration
+	middleware string
+	depth      int
+
+	failures *failureLimiter
+
+	totpMu       sync.Mutex
+	lastTOTPStep int64 // The time step of the last accepted TOTP code, a code is accepted only once.
+}
+
+// defaultSelfServiceDuration is how long a self-service grant lasts, if no duration is configured.
+const defaultSelfServiceDuration = 12 * time.Hour
+
+// After a failed authentication, a client has to wait authBackoff before its next attempt,
+// twice as long after every further failure, up to maxAuthBackoff. A success resets the client.
+const (
+	authBackoff    = time.Second
+	maxAuthBackoff = 24 * time.Hour
+)
+
+func newSelfService(config *SelfServiceConfig, whitelists []whitelist) (*selfService, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if config.Address == "" {
+		return nil, fmt.Errorf("self-service: address is required")
+	}
+
+	if len(config.Tokens) == 0 && config.TOTPSecret == "" {
+		return nil, fmt.Errorf("self-service: tokens or a TOTP secret are required")
+	}
+
+	for _, token := range config.Tokens {
+		if len(token) < 16 {
+			return nil, fmt.Errorf("self-service: tokens must be at least 16 characters long")
+		}
+	}
+
+	var totpSecret []byte
+
+	if config.TOTPSecret != "" {
+		var err error
+
+		totpSecret, err = decodeTOTPSecret(config.TOTPSecret)
+		if err != nil {
+			return nil, fmt.Errorf("self-service: TOTP secret: %w", err)
+		}
+	}
+
+	duration := defaultSelfServiceDuration
+	if config.Duration != "" {
+		var err error
+
+		duration, err = time.ParseDuration(config.Duration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("self-service: invalid duration %q", config.Duration)
+		}
+	}
+
+	middleware := config.Middleware
+	if middleware == "" {
+		middleware = whitelistMiddleware
+	}
+
+	if !containsWhitelist(whitelists, middleware) {
+		return nil, fmt.Errorf("self-service: unknown whitelist middleware %q", middleware)
+	}
+
+	if config.Depth < 0 {
+		return nil, fmt.Errorf("self-service: depth must not be negative")
+	}
+
+	return &selfService{
+		address:    config.Address,
+		tokens:     copyStrings(config.Tokens),
+		totpSecret: totpSecret,
+		duration:   duration,
+		middleware: middleware,
+		depth:      config.Depth,
+		failures:   newFailureLimiter(authBackoff, maxAuthBackoff),
+	}, nil
+}
+
+// selfServiceHandler returns the handler of the self-service endpoint.
+func (p *Provider) selfServiceHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whitelist-me", p.handleWhitelistMe)
+
+	return mux
+}
+
+// handleWhitelistMe grants the caller's IP for the configured duration, if the request carries a valid token.
+// The token is either sent as bearer token or as the form value "token".
+func (p *Provider) handleWhitelistMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := p.clock.Now()
+
+	ip, err := clientIP(r, p.selfService.depth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := failureClient(ip)
+
+	if wait := p.selfService.failures.blocked(client, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<12)
+		token = r.PostFormValue("token")
+	}
+
+	if !p.selfService.authenticate(token, now) {
+		p.selfService.failures.add(client, now)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+		return
+	}
+
+	p.selfService.failures.reset(client)
+
+	g := grant{
+		SourceRange: ip.String(),
+		Middleware:  p.selfService.middleware,
+		Expires:     now.Add(p.selfService.duration),
+		Origin:      grantOriginSelfService,
+	}
+
+	// Calling the endpoint again extends the grant instead of adding another one.
+	p.grants.remove(g.SourceRange, g.Middleware)
+	p.grants.add(g)
+	notify(p.regenerate)
+
+	p.log.Info("grant added", "middleware", g.Middleware, "sourceRange", g.SourceRange, "expires", g.Expires, "origin", g.Origin)
+
+	p.writeJSON(w, http.StatusCreated, g)
+}
+
+// authenticate reports whether token is one of the pre-shared tokens or a current TOTP code.
+// A TOTP code is only accepted once, and neither are codes of time steps before it.
+func (s *selfService) authenticate(token string, now time.Time) bool {
+	if token == "" {
+		return false
+	}
+
+	valid := false
+
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+
+	if valid || s.totpSecret == nil {
+		return valid
+	}
+
+	s.totpMu.Lock()
+	defer s.totpMu.Unlock()
+
+	// One time step of clock skew is tolerated in both directions.
+	var accepted int64
+
+	for skew := -1; skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew) * totpStep)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(totp(s.totpSecret, t))) == 1 {
+			accepted = totpCounter(t)
+		}
+	}
+
+	if accepted <= s.lastTOTPStep {
+		return false
+	}
+
+	s.lastTOTPStep = accepted
+
+	return true
+}
+
+// clientIP returns the IP of the caller. With a depth greater than 0, the IP is taken from the
+// X-Forwarded-For header, counting depth entries from the right, like Traefik's IP strategy does.
+func clientIP(r *http.Request, depth int) (net.IP, error) {
+	if depth > 0 {
+		var forwarded []string
+
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(header, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(entry))
+			}
+		}
+
+		if len(forwarded) < depth {
+			return nil, fmt.Errorf("X-Forwarded-For has less than %d entries", depth)
+		}
+
+		ip := net.ParseIP(forwarded[len(forwarded)-depth])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid X-Forwarded-For entry %q", forwarded[len(forwarded)-depth])
+		}
+
+		return ip, nil
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+
+	return ip, nil
+}
+
+// failureClient returns the key failed authentications of ip are counted under.
+// An IPv6 client usually has a whole /64, so it can't escape the backoff by changing its address.
+func failureClient(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// failureLimiter slows down guessing tokens, by making every client wait longer after each failed authentication.
+// Clients are tracked separately, so a client guessing tokens doesn't lock out the others.
+type failureLimiter struct {
+	backoff time.Duration
+	max     time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*clientFailures
+}
+
+// clientFailures are the failed authentications of a client.
+type clientFailures struct {
+	failures int
+	until    time.Time // The time the client may try again.
+}
+
+func newFailureLimiter(backoff, max time.Duration) *failureLimiter {
+	return &failureLimiter{backoff: backoff, max: max, clients: map[string]*clientFailures{}}
+}
+
+// add records a failed authentication of client.
+func (l *failureLimiter) add(client string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A client that has been quiet for the longest backoff starts over, so the map doesn't grow forever.
+	for key, c := range l.clients {
+		if now.Sub(c.until) >= l.max {
+			delete(l.clients, key)
+		}
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientFailures{}
+		l.clients[client] = c
+	}
+
+	wait := l.backoff
+	for i := 0; i < c.failures && wait < l.max; i++ {
+		wait *= 2
+	}
+
+	if wait > l.max {
+		wait = l.max
+	}
+
+	c.failures++
+	c.until = now.Add(wait)
+}
+
+// reset forgets the failed authentications of client.
+func (l *failureLimiter) reset(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.clients, client)
+}
+
+// blocked returns how long client has to wait before its next attempt, or 0 if it may try now.
+func (l *failureLimiter) blocked(client string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[client]
+	if !ok || !now.Before(c.until) {
+		return 0
+	}
+
+	return c.until.Sub(now)
+}
+
+// totpStep is the time step of TOTP codes.
+const totpStep = 30 * time.Second
+
+// totpCounter returns the number of the time step of t.
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpStep/time.Second)
+}
+
+// totp returns the six digit TOTP code (RFC 6238, HMAC-SHA1) of secret at t.
+func totp(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(totpCounter(t)))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// decodeTOTPSecret decodes a base32 secret as shown by authenticator apps, spaces and missing padding are accepted.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) < 10 {
+		return nil, fmt.Errorf("secret must be at least 80 bits long, got %d", len(key)*8)
+	}
+
+	return key, nil
+}
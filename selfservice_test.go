@@ -0,0 +1,179 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to six digits.
+	secret := []byte("12345678901234567890")
+
+	testCases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range testCases {
+		if code := totp(secret, time.Unix(unix, 0)); code != expected {
+			t.Errorf("%d: got %s, want %s", unix, code, expected)
+		}
+	}
+}
+
+func TestDecodeTOTPSecret(t *testing.T) {
+	key, err := decodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(key) != "12345678901234567890" {
+		t.Errorf("got %q", key)
+	}
+
+	if _, err = decodeTOTPSecret("GEZDGNBV"); err == nil {
+		t.Error("expected an error for a short secret")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/whitelist-me", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+	req.Header.Add("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+
+	testCases := map[int]string{
+		0: "192.0.2.1",
+		1: "10.0.0.2",
+		3: "203.0.113.7",
+	}
+
+	for depth, expected := range testCases {
+		ip, err := clientIP(req, depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ip.String() != expected {
+			t.Errorf("depth %d: got %s, want %s", depth, ip, expected)
+		}
+	}
+
+	if _, err := clientIP(req, 4); err == nil {
+		t.Error("expected an error for a depth beyond X-Forwarded-For")
+	}
+}
+
+func TestWhitelistMe(t *testing.T) {
+	config := CreateConfig()
+	config.SelfService = &SelfServiceConfig{
+		Address:    "127.0.0.1:0",
+		Tokens:     []string{"correct-horse-battery-staple"},
+		TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		Duration:   "2h",
+		Depth:      1,
+	}
+
+	clock := newFakeClock()
+
+	p, err := newProvider(context.Background(), config, "test", withClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whitelistMe := func(client, header, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/whitelist-me", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", client)
+
+		if header != "" {
+			req.Header.Set("Authorization", "Bearer "+header)
+		}
+
+		rec := httptest.NewRecorder()
+		p.handleWhitelistMe(rec, req)
+
+		return rec.Code
+	}
+
+	if code := whitelistMe("203.0.113.7", "correct-horse-battery-staple", ""); code != http.StatusCreated {
+		t.Fatalf("token: got status %d", code)
+	}
+
+	code := totp(p.selfService.totpSecret, clock.Now())
+
+	if status := whitelistMe("203.0.113.7", "", code); status != http.StatusCreated {
+		t.Fatalf("TOTP code: got status %d", status)
+	}
+
+	grants := p.grants.active(clock.Now())
+	if len(grants) != 1 || grants[0].SourceRange != "203.0.113.7" || grants[0].Middleware != whitelistMiddleware {
+		t.Fatalf("unexpected grants %+v", grants)
+	}
+
+	if until := grants[0].Expires.Sub(clock.Now()); until != 2*time.Hour {
+		t.Errorf("unexpected expiry %s", grants[0].Expires)
+	}
+
+	select {
+	case <-p.regenerate:
+	default:
+		t.Error("no new configuration was requested")
+	}
+
+	// A TOTP code can't be replayed, not even by another client.
+	if status := whitelistMe("198.51.100.1", "", code); status != http.StatusUnauthorized {
+		t.Errorf("replayed TOTP code: got status %d", status)
+	}
+
+	// The wait after a failure doubles, and only the failing client has to wait.
+	for i, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if status := whitelistMe("2001:db8::1", "wrong-token", ""); status != http.StatusUnauthorized {
+			t.Fatalf("failure %d: got status %d", i, status)
+		}
+
+		clock.Advance(wait - time.Millisecond)
+
+		if status := whitelistMe("2001:db8::2", "correct-horse-battery-staple", ""); status != http.StatusTooManyRequests {
+			t.Errorf("failure %d: got status %d within the same /64", i, status)
+		}
+
+		clock.Advance(time.Millisecond)
+	}
+
+	if status := whitelistMe("203.0.113.7", "correct-horse-battery-staple", ""); status != http.StatusCreated {
+		t.Errorf("other client: got status %d", status)
+	}
+
+	if status := whitelistMe("2001:db8::1", "correct-horse-battery-staple", ""); status != http.StatusCreated {
+		t.Errorf("after the backoff: got status %d", status)
+	}
+}
+
+func TestFailureLimiterBackoff(t *testing.T) {
+	l := newFailureLimiter(time.Second, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		l.add("client", now)
+	}
+
+	if wait := l.blocked("client", now); wait != time.Minute {
+		t.Errorf("got %s, want the maximum backoff", wait)
+	}
+
+	// A client is forgotten after it was quiet for the maximum backoff.
+	l.add("other", now.Add(2*time.Minute))
+
+	if _, ok := l.clients["client"]; ok {
+		t.Error("the quiet client wasn't forgotten")
+	}
+}
@@ -4,25 +4,61 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/traefik/genconf/dynamic"
 	"github.com/traefik/genconf/dynamic/tls"
 )
 
+// whitelistMiddleware is the name of the generated IPWhiteList middleware.
+const whitelistMiddleware = "public_ipwhitelist"
+
 // Config the plugin configuration.
 type Config struct {
-	PollInterval          string   `json:"pollInterval,omitempty"`
-	IPv4Resolver          string   `json:"ipv4Resolver,omitempty"`
-	IPv6Resolver          string   `json:"ipv6Resolver,omitempty"`
-	WhitelistIPv6         bool     `json:"whitelistIPv6,omitempty"`
-	AdditionalSourceRange []string `json:"additionalSourceRange,omitempty"`
-	IPStrategy            dynamic.IPStrategy
+	PollInterval            string               `json:"pollInterval,omitempty"`
+	IPv4Resolver            string               `json:"ipv4Resolver,omitempty"`
+	IPv6Resolver            string               `json:"ipv6Resolver,omitempty"`
+	WANs                    map[string]WANConfig `json:"wans,omitempty"`
+	WhitelistIPv4           bool                 `json:"whitelistIPv4,omitempty"`
+	WhitelistIPv6           bool                 `json:"whitelistIPv6,omitempty"`
+	AdditionalSourceRange   []string             `json:"additionalSourceRange,omitempty"`
+	ExcludedSourceRange     []string             `json:"excludedSourceRange,omitempty"`
+	IPStrategy              dynamic.IPStrategy
+	AdminAddress            string                     `json:"adminAddress,omitempty"`
+	AdminToken              string                     `json:"adminToken,omitempty"`
+	MinRefreshInterval      string                     `json:"minRefreshInterval,omitempty"`
+	WatchNetwork            bool                       `json:"watchNetwork,omitempty"`
+	NetworkCheckInterval    string                     `json:"networkCheckInterval,omitempty"`
+	Routes                  map[string]RouteConfig     `json:"routes,omitempty"`
+	Chain                   *ChainConfig               `json:"chain,omitempty"`
+	Whitelists              map[string]WhitelistConfig `json:"whitelists,omitempty"`
+	GrantsFile              string                     `json:"grantsFile,omitempty"`
+	GrantsFileCheckInterval string                     `json:"grantsFileCheckInterval,omitempty"`
+	GrantMinPrefixIPv4      int                        `json:"grantMinPrefixIPv4,omitempty"`
+	GrantMinPrefixIPv6      int                        `json:"grantMinPrefixIPv6,omitempty"`
+	SelfService             *SelfServiceConfig         `json:"selfService,omitempty"`
+	Schedules               []ScheduleConfig           `json:"schedules,omitempty"`
+	OnResolveFailure        string                     `json:"onResolveFailure,omitempty"`
+	BogonPolicy             string                     `json:"bogonPolicy,omitempty"`
+	IPHistorySize           int                        `json:"ipHistorySize,omitempty"`
+	IPHistoryRetention      string                     `json:"ipHistoryRetention,omitempty"`
+	IPHistoryFile           string                     `json:"ipHistoryFile,omitempty"`
+	LogLevel                string                     `json:"logLevel,omitempty"`
+	LogFormat               string                     `json:"logFormat,omitempty"`
+	AuditFile               string                     `json:"auditFile,omitempty"`
+	AuditMaxSize            int                        `json:"auditMaxSize,omitempty"`
+	AuditMaxBackups         int                        `json:"auditMaxBackups,omitempty"`
+	Countries               []string                   `json:"countries,omitempty"`
+	GeoIPDatabase           string                     `json:"geoIPDatabase,omitempty"`
+	GeoIPCheckInterval      string                     `json:"geoIPCheckInterval,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -31,44 +67,287 @@ func CreateConfig() *Config {
 		PollInterval:          "300s",
 		IPv4Resolver:          "https://api4.ipify.org/?format=text",
 		IPv6Resolver:          "https://api6.ipify.org/?format=text",
+		WhitelistIPv4:         true,
 		WhitelistIPv6:         false,
 		AdditionalSourceRange: []string{},
+		ExcludedSourceRange:   []string{},
 		IPStrategy: dynamic.IPStrategy{
 			Depth:       0,
 			ExcludedIPs: nil,
 		},
+		AdminAddress:            "",
+		MinRefreshInterval:      "10s",
+		WatchNetwork:            false,
+		NetworkCheckInterval:    "5s",
+		Routes:                  map[string]RouteConfig{},
+		Whitelists:              map[string]WhitelistConfig{},
+		GrantsFile:              "",
+		GrantsFileCheckInterval: "5s",
+		GrantMinPrefixIPv4:      24,
+		GrantMinPrefixIPv6:      48,
+		OnResolveFailure:        resolveFailureKeep,
+		BogonPolicy:             bogonPolicyReject,
+		LogLevel:                "info",
+		LogFormat:               logFormatText,
+		AuditFile:               "",
+		AuditMaxSize:            10 << 20,
+		AuditMaxBackups:         5,
+		GeoIPCheckInterval:      "1m",
 	}
 }
 
+// Policies for a failed resolution of the public IPs.
+const (
+	// resolveFailureKeep keeps whitelisting the last public IPs that were resolved successfully.
+	resolveFailureKeep = "keep"
+	// resolveFailureRemove removes the public IPs from the whitelists until they are resolved again.
+	resolveFailureRemove = "remove"
+)
+
 // Provider a simple provider plugin.
+// Its settings are copied from the Config in New and never modified afterwards,
+// so every poll generates its configuration from the same immutable inputs.
 type Provider struct {
-	name                  string
-	pollInterval          time.Duration
-	ipv4Resolver          string
-	ipv6Resolver          string
-	whitelistIPv6         bool
-	additionalSourceRange []string
-	ipStrategy            dynamic.IPStrategy
+	name                    string
+	pollInterval            time.Duration
+	wans                    []wan
+	whitelistIPv4           bool
+	whitelistIPv6           bool
+	whitelists              []whitelist
+	ipStrategy              dynamic.IPStrategy
+	adminAddress            string
+	adminToken              string
+	watchNetwork            bool
+	networkCheckInterval    time.Duration
+	routes                  map[string]RouteConfig
+	chain                   *ChainConfig
+	grantsFileCheckInterval time.Duration
+	grantLimits             grantLimits
+	geoIPCheckInterval      time.Duration
+	selfService             *selfService
+	schedules               []schedule
+	onResolveFailure        string
+	bogonPolicy             string
+	clock                   clock
+	log                     *logger
 
-	cancel func()
+	history   *ipHistory
+	auditLog  *auditLog
+	geoIP     *geoIPDatabase
+	published map[string][]string // The source ranges last sent to Traefik, only used by loadConfiguration.
+
+	refresh           *refresher
+	regenerate        chan struct{}
+	grants            *grantStore
+	admin             *httpServer
+	selfServiceServer *httpServer
+	cancel            func()
+	goroutines        sync.WaitGroup
+	done              chan struct{}
+	stopTimeout       time.Duration
+	resolveTimeout    time.Duration
+
+	statusMu  sync.Mutex
+	status    status
+	wanHealth map[string]wanHealth
 }
 
 // New creates a new Provider plugin.
 func New(ctx context.Context, config *Config, name string) (*Provider, error) {
+	return newProvider(ctx, config, name)
+}
+
+// option replaces a dependency of the provider, so tests can run it without the network and the wall clock.
+type option func(*Provider)
+
+// withClock makes the provider use c instead of the time package.
+func withClock(c clock) option {
+	return func(p *Provider) {
+		p.clock = c
+	}
+}
+
+// withLogOutput makes the provider log to w instead of stderr.
+func withLogOutput(w io.Writer) option {
+	return func(p *Provider) {
+		p.log.out = &logOutput{w: w}
+	}
+}
+
+// withResolvers makes the provider resolve its public IPs with ipv4 and ipv6 instead of the configured resolvers.
+func withResolvers(ipv4, ipv6 resolver) option {
+	return withWANResolvers(defaultWAN, ipv4, ipv6)
+}
+
+// withWANResolvers makes the provider resolve the public IPs of a WAN with ipv4 and ipv6 instead of its resolvers.
+func withWANResolvers(name string, ipv4, ipv6 resolver) option {
+	return func(p *Provider) {
+		for i := range p.wans {
+			if p.wans[i].name == name {
+				p.wans[i].ipv4Resolver = ipv4
+				p.wans[i].ipv6Resolver = ipv6
+			}
+		}
+	}
+}
+
+func newProvider(_ context.Context, config *Config, name string, options ...option) (*Provider, error) {
 	pi, err := time.ParseDuration(config.PollInterval)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Provider{
-		name:                  name,
-		pollInterval:          pi,
-		ipv4Resolver:          config.IPv4Resolver,
-		ipv6Resolver:          config.IPv6Resolver,
-		whitelistIPv6:         config.WhitelistIPv6,
-		additionalSourceRange: config.AdditionalSourceRange,
-		ipStrategy:            config.IPStrategy,
-	}, nil
+	minRefreshInterval, err := time.ParseDuration(config.MinRefreshInterval)
+	if err != nil {
+		return nil, fmt.Errorf("min refresh interval: %w", err)
+	}
+
+	networkCheckInterval, err := time.ParseDuration(config.NetworkCheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("network check interval: %w", err)
+	}
+
+	grantsFileCheckInterval, err := time.ParseDuration(config.GrantsFileCheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("grants file check interval: %w", err)
+	}
+
+	whitelists, err := newWhitelists(config)
+	if err != nil {
+		return nil, err
+	}
+
+	geoIP, err := newGeoIPDatabase(config.GeoIPDatabase, whitelists)
+	if err != nil {
+		return nil, err
+	}
+
+	var geoIPCheckInterval time.Duration
+
+	if geoIP != nil {
+		geoIPCheckInterval, err = time.ParseDuration(config.GeoIPCheckInterval)
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP check interval: %w", err)
+		}
+	}
+
+	chain, err := newChain(config.Chain)
+	if err != nil {
+		return nil, err
+	}
+
+	middlewares := make(map[string]bool, len(whitelists)+1)
+	for _, wl := range whitelists {
+		middlewares[wl.name] = true
+	}
+
+	if err = validateChain(chain, middlewares, config); err != nil {
+		return nil, err
+	}
+
+	if err := validateRoutes(config.Routes, middlewares); err != nil {
+		return nil, err
+	}
+
+	selfService, err := newSelfService(config.SelfService, whitelists)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := newSchedules(config.Schedules, whitelists)
+	if err != nil {
+		return nil, err
+	}
+
+	onResolveFailure := config.OnResolveFailure
+	if onResolveFailure == "" {
+		onResolveFailure = resolveFailureKeep
+	}
+
+	if onResolveFailure != resolveFailureKeep && onResolveFailure != resolveFailureRemove {
+		return nil, fmt.Errorf("invalid resolve failure policy %q", config.OnResolveFailure)
+	}
+
+	bogonPolicy := config.BogonPolicy
+	if bogonPolicy == "" {
+		bogonPolicy = bogonPolicyReject
+	}
+
+	if bogonPolicy != bogonPolicyReject && bogonPolicy != bogonPolicyWarn && bogonPolicy != bogonPolicyAllow {
+		return nil, fmt.Errorf("invalid bogon policy %q", config.BogonPolicy)
+	}
+
+	wans, err := newWANs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := newIPHistory(config.IPHistorySize, config.IPHistoryRetention, config.IPHistoryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := newLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := newAuditLog(config.AuditFile, int64(config.AuditMaxSize), config.AuditMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateAdminAddress(config.AdminAddress, config.AdminToken); err != nil {
+		return nil, err
+	}
+
+	grantLimits, err := newGrantLimits(config.GrantMinPrefixIPv4, config.GrantMinPrefixIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		name:          name,
+		pollInterval:  pi,
+		wans:          wans,
+		whitelistIPv4: config.WhitelistIPv4,
+		whitelistIPv6: config.WhitelistIPv6,
+		whitelists:    whitelists,
+		ipStrategy: dynamic.IPStrategy{
+			Depth:       config.IPStrategy.Depth,
+			ExcludedIPs: copyStrings(config.IPStrategy.ExcludedIPs),
+		},
+		adminAddress:            config.AdminAddress,
+		adminToken:              config.AdminToken,
+		watchNetwork:            config.WatchNetwork,
+		networkCheckInterval:    networkCheckInterval,
+		routes:                  copyRoutes(config.Routes),
+		chain:                   chain,
+		grantsFileCheckInterval: grantsFileCheckInterval,
+		grantLimits:             grantLimits,
+		geoIPCheckInterval:      geoIPCheckInterval,
+		selfService:             selfService,
+		schedules:               schedules,
+		onResolveFailure:        onResolveFailure,
+		bogonPolicy:             bogonPolicy,
+		clock:                   realClock{},
+		log:                     log.with("provider", name),
+		history:                 history,
+		auditLog:                auditLog,
+		geoIP:                   geoIP,
+		refresh:                 newRefresher(minRefreshInterval),
+		regenerate:              make(chan struct{}, 1),
+		grants:                  &grantStore{file: config.GrantsFile},
+		stopTimeout:             defaultStopTimeout,
+		resolveTimeout:          defaultResolveTimeout,
+		wanHealth:               make(map[string]wanHealth, len(wans)),
+	}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	return p, nil
 }
 
 // Init the provider.
@@ -77,39 +356,176 @@ func (p *Provider) Init() error {
 		return fmt.Errorf("poll interval must be greater than 0")
 	}
 
+	if p.watchNetwork && p.networkCheckInterval <= 0 {
+		return fmt.Errorf("network check interval must be greater than 0")
+	}
+
+	if p.grants.file != "" && p.grantsFileCheckInterval <= 0 {
+		return fmt.Errorf("grants file check interval must be greater than 0")
+	}
+
+	if p.geoIP != nil && p.geoIPCheckInterval <= 0 {
+		return fmt.Errorf("GeoIP check interval must be greater than 0")
+	}
+
 	return nil
 }
 
 // Provide creates and send dynamic configuration.
 func (p *Provider) Provide(cfgChan chan<- json.Marshaler) error {
+	if err := p.startServers(); err != nil {
+		return err
+	}
+
+	if p.grants.file != "" {
+		if _, err := p.grants.reloadFile(p); err != nil {
+			p.log.Error("loading grants file failed", "file", p.grants.file, "error", err)
+		}
+	}
+
+	// Without the database, the countries are missing from the whitelists until it can be read.
+	if p.geoIP != nil {
+		if _, err := p.geoIP.reload(); err != nil {
+			p.log.Error("loading GeoIP database failed", "file", p.geoIP.file, "error", err)
+		}
+	}
+
+	if err := p.history.load(); err != nil {
+		p.log.Error("loading IP history failed", "file", p.history.file, "error", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	p.start(func() { p.loadConfiguration(ctx, cfgChan) })
+
+	if p.watchNetwork {
+		p.start(func() { p.watchNetworkChanges(ctx) })
+	}
+
+	if p.grants.file != "" {
+		p.start(func() { p.watchGrantsFile(ctx) })
+	}
+
+	if p.geoIP != nil {
+		p.start(func() { p.watchGeoIPDatabase(ctx) })
+	}
 
+	go func() {
+		p.goroutines.Wait()
+		close(p.done)
+	}()
+
+	return nil
+}
+
+// startServers starts the admin API and the self-service endpoint, if they are enabled.
+// Both listeners are opened before serving, so none is left behind if the other one fails:
+// Traefik doesn't call Stop after Provide returned an error.
+func (p *Provider) startServers() error {
+	var admin, selfServiceServer *httpServer
+
+	if p.adminAddress != "" {
+		var err error
+
+		admin, err = newHTTPServer(p.adminAddress, p.adminHandler(), p.log.with("server", "admin"))
+		if err != nil {
+			return fmt.Errorf("admin API: %w", err)
+		}
+	}
+
+	if p.selfService != nil {
+		var err error
+
+		selfServiceServer, err = newHTTPServer(p.selfService.address, p.selfServiceHandler(), p.log.with("server", "self-service"))
+		if err != nil {
+			if admin != nil {
+				_ = admin.listener.Close()
+			}
+
+			return fmt.Errorf("self-service: %w", err)
+		}
+	}
+
+	for _, server := range []*httpServer{admin, selfServiceServer} {
+		if server != nil {
+			go server.serve()
+		}
+	}
+
+	p.admin, p.selfServiceServer = admin, selfServiceServer
+
+	return nil
+}
+
+// start runs fn in a new goroutine, that Stop waits for.
+func (p *Provider) start(fn func()) {
+	p.goroutines.Add(1)
+
+	safeGo(p.log, func() {
+		defer p.goroutines.Done()
+		fn()
+	})
+}
+
+// safeGo runs fn in a new goroutine and logs a panic instead of crashing Traefik.
+func safeGo(log *logger, fn func()) {
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Print(err)
+				log.Error("recovered from panic", "error", fmt.Sprint(err))
 			}
 		}()
 
-		p.loadConfiguration(ctx, cfgChan)
+		fn()
 	}()
-
-	return nil
 }
 
 func (p *Provider) loadConfiguration(ctx context.Context, cfgChan chan<- json.Marshaler) {
-	ticker := time.NewTicker(p.pollInterval)
+	ticker := p.clock.NewTicker(p.pollInterval)
 	defer ticker.Stop()
 
-	configuration := generateConfiguration(p)
-	cfgChan <- &dynamic.JSONPayload{Configuration: configuration}
+	// next fires when the configuration changes without new input, e.g. when a grant expires or a schedule window opens.
+	next := &deadline{clock: p.clock}
+	defer next.set(time.Time{})
+
+	// A resolution can take a while, the provider may have been stopped in the meantime.
+	ipAddresses := p.resolvePublicIPs(ctx, wanAddresses{})
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.recordAddresses(ipAddresses)
+	next.set(p.publish(ctx, cfgChan, ipAddresses))
+
+	// Later resolutions run in the background, so a hanging resolver doesn't hold back expiring grants and schedule windows.
+	r := &resolution{done: make(chan wanAddresses, 1)}
 
 	for {
 		select {
-		case <-ticker.C:
-			configuration := generateConfiguration(p)
-			cfgChan <- &dynamic.JSONPayload{Configuration: configuration}
+		case <-ticker.C():
+			p.startResolution(ctx, r, ipAddresses)
+
+		case <-p.refresh.trigger:
+			p.startResolution(ctx, r, ipAddresses)
+			ticker.Reset(p.pollInterval)
+
+		case resolved := <-r.done:
+			if ctx.Err() != nil {
+				return
+			}
+
+			ipAddresses = resolved
+			p.recordAddresses(ipAddresses)
+			next.set(p.publish(ctx, cfgChan, ipAddresses))
+			r.finished(func() { p.startResolution(ctx, r, ipAddresses) })
+
+		case <-p.regenerate:
+			next.set(p.publish(ctx, cfgChan, ipAddresses))
+
+		case <-next.C():
+			next.set(p.publish(ctx, cfgChan, ipAddresses))
 
 		case <-ctx.Done():
 			return
@@ -117,9 +533,116 @@ func (p *Provider) loadConfiguration(ctx context.Context, cfgChan chan<- json.Ma
 	}
 }
 
+// resolution tracks the background resolution of the poll loop. Only one runs at a time.
+type resolution struct {
+	done    chan wanAddresses
+	running bool
+	// pending is set when a resolution is requested while one is running, it starts once that one finished.
+	pending bool
+}
+
+// finished marks the running resolution as finished and calls restart if another one was requested meanwhile.
+func (r *resolution) finished(restart func()) {
+	r.running = false
+
+	if r.pending {
+		r.pending = false
+		restart()
+	}
+}
+
+// startResolution resolves the public IPs in the background, the poll loop receives them from r.done.
+func (p *Provider) startResolution(ctx context.Context, r *resolution, last wanAddresses) {
+	if r.running {
+		r.pending = true
+		return
+	}
+
+	r.running = true
+
+	p.start(func() {
+		// r.done has room for the only running resolution, so this doesn't block after the loop returned.
+		r.done <- p.resolvePublicIPs(ctx, last)
+	})
+}
+
+// recordAddresses adds the resolved addresses to the IP history.
+func (p *Provider) recordAddresses(ipAddresses wanAddresses) {
+	if p.history.record(p.clock.Now(), ipAddresses) {
+		if err := p.history.save(); err != nil {
+			p.log.Error("saving IP history failed", "file", p.history.file, "error", err)
+		}
+	}
+}
+
+// deadline is a timer that can be moved.
+type deadline struct {
+	clock clock
+	timer timer
+}
+
+// set moves the deadline to t. The zero time disables it.
+func (d *deadline) set(t time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	if !t.IsZero() {
+		d.timer = d.clock.NewTimer(t.Sub(d.clock.Now()))
+	}
+}
+
+// C returns the channel the deadline fires on, or nil if it's disabled.
+func (d *deadline) C() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+
+	return d.timer.C()
+}
+
+// notify wakes up the receiver of ch without blocking, if it isn't notified already.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// defaultStopTimeout is how long Stop waits for the go routines of the provider to return.
+const defaultStopTimeout = 5 * time.Second
+
 // Stop to stop the provider and the related go routines.
+// It waits until they returned, so no configuration is sent after Stop returned.
 func (p *Provider) Stop() error {
-	p.cancel()
+	var errs []string
+
+	// Stop may be called without a preceding Provide, e.g. when another provider failed to start.
+	if p.cancel != nil {
+		p.cancel()
+
+		select {
+		case <-p.done:
+		case <-time.After(p.stopTimeout):
+			errs = append(errs, fmt.Sprintf("go routines still running after %s", p.stopTimeout))
+		}
+	}
+
+	for _, server := range []*httpServer{p.admin, p.selfServiceServer} {
+		if server == nil {
+			continue
+		}
+
+		if err := server.shutdown(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("stopping provider: %s", strings.Join(errs, ", "))
+	}
+
 	return nil
 }
 
@@ -148,65 +671,465 @@ func ipv6ToCIDR(ipv6 string) (string, error) {
 	return cidr, nil
 }
 
-func getPublicIp(ipv4Resolver string, ipv6Resolver string, whitelistIpv6 bool) (IPAddresses, error) {
-	ipv4, err := getBody(ipv4Resolver)
+// resolver looks up a public IP. It gives up as soon as ctx is done.
+type resolver interface {
+	resolve(ctx context.Context) (string, error)
+}
+
+// httpResolver asks a web service that answers with the IP of the caller in plain text.
+type httpResolver struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPResolver returns a resolver that only connects over network, "tcp4" or "tcp6".
+// The web service sees the address of the family that is resolved, even if its host name has addresses of both.
+// If source is not nil, connections are made from the local address it returns.
+func newHTTPResolver(url, network string, source func() (net.IP, error)) httpResolver {
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	return httpResolver{
+		url: url,
+		client: &http.Client{
+			Timeout: defaultResolveTimeout,
+			Transport: &http.Transport{
+				// No proxy, the web service would see the proxy's address instead of ours.
+				Proxy: nil,
+				DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+					d := dialer
 
+					if source != nil {
+						ip, err := source()
+						if err != nil {
+							return nil, err
+						}
+
+						d.LocalAddr = &net.TCPAddr{IP: ip}
+					}
+
+					return d.DialContext(ctx, network, address)
+				},
+				// A connection would keep its local address, even if the source changed.
+				DisableKeepAlives:     source != nil,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          1,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 10 * time.Second,
+			},
+		},
+	}
+}
+
+// String returns the URL of the web service, without a password.
+func (r httpResolver) String() string {
+	u, err := neturl.Parse(r.url)
 	if err != nil {
-		return IPAddresses{}, err
+		return r.url
 	}
 
-	if net.ParseIP(ipv4) == nil {
-		return IPAddresses{}, fmt.Errorf("could not parse resolver response")
+	return u.Redacted()
+}
+
+func (r httpResolver) resolve(ctx context.Context) (string, error) {
+	body, err := getBody(ctx, r.client, r.url)
+	if err != nil {
+		return "", err
 	}
 
-	if !whitelistIpv6 {
-		return IPAddresses{
-			v4:     ipv4,
-			v6CIDR: "",
-		}, nil
+	return strings.TrimSpace(body), nil
+}
+
+// resolveIPv4 resolves the public IPv4 address through ipv4Resolver
+// and reports whether it is in the shared address space of carrier-grade NAT.
+func (p *Provider) resolveIPv4(ctx context.Context, ipv4Resolver resolver) (string, bool, error) {
+	ipv4, err := ipv4Resolver.resolve(ctx)
+	if err != nil {
+		return "", false, err
 	}
 
-	ipv6, err := getBody(ipv6Resolver)
+	ip := net.ParseIP(ipv4)
+	if ip == nil {
+		return "", false, fmt.Errorf("could not parse resolver response")
+	}
+
+	if ip.To4() == nil {
+		return "", false, fmt.Errorf("resolver returned %s, which is not an IPv4 address", ipv4)
+	}
+
+	class, _ := classifyBogon(ip)
+	cgnat := class == bogonCGNAT
+
+	if err = p.checkPublicIP(ip); err != nil {
+		return "", cgnat, err
+	}
 
+	return ipv4, cgnat, nil
+}
+
+// resolveIPv6CIDR resolves the public IPv6 address through ipv6Resolver and returns the network it belongs to.
+func (p *Provider) resolveIPv6CIDR(ctx context.Context, ipv6Resolver resolver) (string, error) {
+	ipv6, err := ipv6Resolver.resolve(ctx)
 	if err != nil {
-		return IPAddresses{}, err
+		return "", err
 	}
 
-	if net.ParseIP(ipv6) == nil {
-		return IPAddresses{}, fmt.Errorf("could not parse resolver response")
+	ip := net.ParseIP(ipv6)
+	if ip == nil {
+		return "", fmt.Errorf("could not parse resolver response")
 	}
 
-	ipv6CIDR, err := ipv6ToCIDR(ipv6)
+	if ip.To4() != nil {
+		return "", fmt.Errorf("resolver returned %s, which is not an IPv6 address", ipv6)
+	}
 
+	cidr, err := ipv6ToCIDR(ipv6)
 	if err != nil {
-		return IPAddresses{}, err
+		return "", err
+	}
+
+	if err = p.checkPublicIP(ip); err != nil {
+		return "", err
 	}
 
-	return IPAddresses{
-		v4:     ipv4,
-		v6CIDR: ipv6CIDR,
-	}, nil
+	return cidr, nil
 }
 
-func getBody(address string) (string, error) {
-	resp, err := http.Get(address)
+func getBody(ctx context.Context, client *http.Client, address string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Print(err)
 		return "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Print(err)
 		return "", err
 	}
 
 	return string(body), nil
 }
 
-func generateConfiguration(provider *Provider) *dynamic.Configuration {
-	configuration := &dynamic.Configuration{
+// defaultResolveTimeout is how long the resolution of all WANs may take, a WAN that doesn't answer in time fails.
+const defaultResolveTimeout = 30 * time.Second
+
+// resolvePublicIPs resolves the current public IPs of all WANs concurrently.
+// A failing WAN doesn't affect the others.
+func (p *Provider) resolvePublicIPs(ctx context.Context, last wanAddresses) wanAddresses {
+	ctx, cancel := context.WithTimeout(ctx, p.resolveTimeout)
+	defer cancel()
+
+	results := make([]IPAddresses, len(p.wans))
+
+	var wg sync.WaitGroup
+
+	for i, w := range p.wans {
+		wg.Add(1)
+
+		go func(i int, w wan) {
+			defer wg.Done()
+
+			results[i] = p.resolveWAN(ctx, w, last[w.name])
+		}(i, w)
+	}
+
+	wg.Wait()
+
+	ipAddresses := make(wanAddresses, len(p.wans))
+	for i, w := range p.wans {
+		ipAddresses[w.name] = results[i]
+	}
+
+	return ipAddresses
+}
+
+// resolveWAN resolves the public IPs of the whitelisted families of a WAN concurrently.
+// The families are independent: if one of them fails, the resolve failure policy decides
+// whether its last known address is kept, the other one is updated anyway.
+func (p *Provider) resolveWAN(ctx context.Context, w wan, last IPAddresses) IPAddresses {
+	var (
+		v4, v6CIDR   string
+		v4Err, v6Err error
+		cgnat        bool
+		wg           sync.WaitGroup
+	)
+
+	if p.whitelistIPv4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			v4, cgnat, v4Err = p.resolveIPv4(ctx, w.ipv4Resolver)
+		}()
+	}
+
+	if p.whitelistIPv6 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			v6CIDR, v6Err = p.resolveIPv6CIDR(ctx, w.ipv6Resolver)
+		}()
+	}
+
+	wg.Wait()
+
+	// Stopping isn't a resolver failure.
+	if ctx.Err() != nil {
+		return last
+	}
+
+	var (
+		ipAddresses IPAddresses
+		health      wanHealth
+	)
+
+	if p.whitelistIPv4 {
+		ipAddresses.v4 = p.afterResolution(w.name, "IPv4", v4, last.v4, v4Err, &health)
+	}
+
+	if p.whitelistIPv6 {
+		ipAddresses.v6CIDR = p.afterResolution(w.name, "IPv6", v6CIDR, last.v6CIDR, v6Err, &health)
+	}
+
+	if len(health.Errors) == 0 {
+		health.LastSuccess = p.clock.Now()
+	}
+
+	health.CGNAT = cgnat
+	p.setWANHealth(w.name, health)
+
+	return ipAddresses
+}
+
+// afterResolution returns the address of a family of a WAN to whitelist after it was resolved to address or failed with err.
+// A failure is recorded in health.
+func (p *Provider) afterResolution(wanName, family, address, last string, err error, health *wanHealth) string {
+	log := p.log.with("family", family)
+	if wanName != defaultWAN {
+		log = log.with("wan", wanName)
+	}
+
+	if err == nil {
+		if address != last {
+			log.Info("public IP changed", "address", address, "previous", last)
+		} else {
+			log.Debug("public IP resolved", "address", address)
+		}
+
+		return address
+	}
+
+	log.Error("resolving public IP failed", "error", err)
+
+	label := family
+	if wanName != defaultWAN {
+		label += " of WAN " + wanName
+	}
+
+	health.Errors = append(health.Errors, fmt.Sprintf("%s: %v", label, err))
+
+	if p.onResolveFailure == resolveFailureRemove {
+		return ""
+	}
+
+	return last
+}
+
+// generationInputs are the inputs of a configuration that change over time.
+// Together with the provider settings they fully determine the generated configuration.
+type generationInputs struct {
+	now         time.Time
+	ipAddresses wanAddresses
+	grants      []grant
+	history     []historyEntry
+	countries   map[string][]string
+	published   map[string][]string // The source ranges last sent to Traefik, by middleware.
+}
+
+// publish generates a new configuration snapshot from the latest public IPs and sends it,
+// unless ctx is done before Traefik receives it.
+// It returns the time at which the configuration changes next without new input, or the zero time.
+func (p *Provider) publish(ctx context.Context, cfgChan chan<- json.Marshaler, ipAddresses wanAddresses) time.Time {
+	now := p.clock.Now()
+
+	inputs := generationInputs{
+		now:         now,
+		ipAddresses: ipAddresses,
+		grants:      p.grants.active(now),
+		history:     p.history.entries(now),
+		countries:   p.geoIP.snapshot(),
+		published:   p.published,
+	}
+
+	configuration, failed, err := generateConfiguration(p, inputs)
+	for _, mErr := range failed {
+		p.log.with("middleware", mErr.middleware).Error("generating whitelist failed, keeping its last source range", "error", mErr.err)
+	}
+
+	if err != nil {
+		p.log.Error("generating configuration failed", "error", err)
+
+		return time.Time{}
+	}
+
+	p.setStatus(now, inputs, configuration)
+
+	select {
+	case cfgChan <- &dynamic.JSONPayload{Configuration: configuration}:
+		p.log.Debug("configuration published")
+		p.audit(inputs, configuration)
+		p.published = publishedSourceRanges(p.whitelists, configuration)
+	case <-ctx.Done():
+		return time.Time{}
+	}
+
+	return earliest(nextExpiry(inputs.grants), nextScheduleBoundary(p.schedules, now), p.history.nextExpiry(inputs.history))
+}
+
+// earliest returns the earliest of times, ignoring zero times.
+func earliest(times ...time.Time) time.Time {
+	var first time.Time
+
+	for _, t := range times {
+		if !t.IsZero() && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+
+	return first
+}
+
+// middlewareError is an error generating a middleware.
+type middlewareError struct {
+	middleware string
+	err        error
+}
+
+func (e *middlewareError) Error() string {
+	return fmt.Sprintf("%s: %v", e.middleware, e.err)
+}
+
+func (e *middlewareError) Unwrap() error {
+	return e.err
+}
+
+// generateConfiguration builds a new configuration from the provider settings and the given inputs.
+// Neither is modified and the result shares no memory with them.
+// A whitelist that can't be generated is returned in failed and keeps its published source range,
+// or is left out if it was never published, so it can't take the other whitelists and the routes down with it.
+func generateConfiguration(provider *Provider, inputs generationInputs) (*dynamic.Configuration, []*middlewareError, error) {
+	configuration := newConfiguration()
+
+	var failed []*middlewareError
+
+	for _, wl := range provider.whitelists {
+		sourceRange, err := buildSourceRange(provider, wl, inputs)
+		if err != nil {
+			failed = append(failed, &middlewareError{middleware: wl.name, err: err})
+
+			published, ok := inputs.published[wl.name]
+			if !ok {
+				continue
+			}
+
+			sourceRange = copyStrings(published)
+		}
+
+		configuration.HTTP.Middlewares[wl.name] = &dynamic.Middleware{
+			IPWhiteList: &dynamic.IPWhiteList{
+				SourceRange: sourceRange,
+				IPStrategy: &dynamic.IPStrategy{
+					Depth:       provider.ipStrategy.Depth,
+					ExcludedIPs: copyStrings(provider.ipStrategy.ExcludedIPs),
+				},
+			},
+		}
+	}
+
+	// Routes are protected by the chain if there is one, otherwise by the whitelist alone.
+	protection := whitelistMiddleware
+
+	var fallback *routeFallback
+
+	if provider.chain != nil {
+		var err error
+
+		protection, err = addChain(configuration, provider.chain, whitelistMiddleware)
+		if err != nil {
+			return nil, failed, err
+		}
+
+		if provider.chain.AuthFallback {
+			fallback = newRouteFallback(provider, configuration)
+		}
+	}
+
+	addRoutes(configuration, provider.routes, protection, fallback)
+
+	return configuration, failed, nil
+}
+
+// whitelistSourceRange returns the source range of the whitelist middleware name of configuration,
+// or false if the whitelist was left out.
+func whitelistSourceRange(configuration *dynamic.Configuration, name string) ([]string, bool) {
+	middleware, ok := configuration.HTTP.Middlewares[name]
+	if !ok || middleware.IPWhiteList == nil {
+		return nil, false
+	}
+
+	return middleware.IPWhiteList.SourceRange, true
+}
+
+// publishedSourceRanges returns copies of the source ranges of the whitelists of configuration, by middleware.
+func publishedSourceRanges(whitelists []whitelist, configuration *dynamic.Configuration) map[string][]string {
+	published := make(map[string][]string, len(whitelists))
+
+	for _, wl := range whitelists {
+		if sourceRange, ok := whitelistSourceRange(configuration, wl.name); ok {
+			published[wl.name] = copyStrings(sourceRange)
+		}
+	}
+
+	return published
+}
+
+func buildSourceRange(provider *Provider, wl whitelist, inputs generationInputs) ([]string, error) {
+	granted := grantSourceRanges(inputs.grants, wl.name)
+	scheduled := scheduledSourceRanges(provider.schedules, wl.name, inputs.now)
+	previous := historySourceRanges(inputs.history, provider.whitelistIPv4, provider.whitelistIPv6)
+	countries := countrySourceRanges(inputs.countries, wl.countries)
+
+	sourceRange := make([]string, 0,
+		len(wl.additionalSourceRange)+len(granted)+len(scheduled)+len(previous)+len(countries)+2)
+	sourceRange = append(sourceRange, wl.additionalSourceRange...)
+	sourceRange = append(sourceRange, granted...)
+	sourceRange = append(sourceRange, scheduled...)
+	sourceRange = append(sourceRange, previous...)
+	sourceRange = append(sourceRange, countries...)
+	// The public IPs are unknown while they couldn't be resolved.
+	for _, ipAddresses := range inputs.ipAddresses {
+		if provider.whitelistIPv4 && ipAddresses.v4 != "" {
+			sourceRange = append(sourceRange, ipAddresses.v4)
+		}
+
+		if provider.whitelistIPv6 && ipAddresses.v6CIDR != "" {
+			sourceRange = append(sourceRange, ipAddresses.v6CIDR)
+		}
+	}
+
+	return aggregateSourceRange(sourceRange, wl.excludedSourceRange)
+}
+
+func newConfiguration() *dynamic.Configuration {
+	return &dynamic.Configuration{
 		HTTP: &dynamic.HTTPConfiguration{
 			Routers:           make(map[string]*dynamic.Router),
 			Middlewares:       make(map[string]*dynamic.Middleware),
@@ -226,28 +1149,12 @@ func generateConfiguration(provider *Provider) *dynamic.Configuration {
 			Services: make(map[string]*dynamic.UDPService),
 		},
 	}
+}
 
-	ipAddresses, err := getPublicIp(provider.ipv4Resolver, provider.ipv6Resolver, provider.whitelistIPv6)
-
-	sourceRange := append(provider.additionalSourceRange, ipAddresses.v4)
-
-	if provider.whitelistIPv6 {
-		sourceRange = append(sourceRange, ipAddresses.v6CIDR)
-	}
-
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	configuration.HTTP.Middlewares["public_ipwhitelist"] = &dynamic.Middleware{
-		IPWhiteList: &dynamic.IPWhiteList{
-			SourceRange: sourceRange,
-			IPStrategy: &dynamic.IPStrategy{
-				Depth:       provider.ipStrategy.Depth,
-				ExcludedIPs: provider.ipStrategy.ExcludedIPs,
-			},
-		},
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
 	}
 
-	return configuration
+	return append(make([]string, 0, len(values)), values...)
 }
@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
-	//"time"
+	"time"
 
 	"github.com/Shoggomo/traefik_dynamic_public_whitelist"
 	"github.com/traefik/genconf/dynamic"
@@ -19,24 +26,39 @@ func TestNew(t *testing.T) {
 	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("192.0.2.123")) // Mock response with a sample IP address
 	}))
-	defer mockServerv4.Close()
-
-	mockServerv6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("1234:1234:1234:1234:1234:1234:1234:1234")) // Mock response with a sample IP address
-	}))
-	defer mockServerv6.Close()
+	t.Cleanup(mockServerv4.Close)
 
 	config := traefik_dynamic_public_whitelist.CreateConfig()
+	// The mock resolvers answer with documentation addresses.
+	config.BogonPolicy = "allow"
 	config.PollInterval = "1s"
 	config.IPv4Resolver = mockServerv4.URL
-	config.IPv6Resolver = mockServerv6.URL
-	config.WhitelistIPv6 = true
 	config.AdditionalSourceRange = []string{"127.0.0.1/32", "192.168.0.24"}
 	config.IPStrategy = dynamic.IPStrategy{
 		Depth:       1,
 		ExcludedIPs: []string{"123.0.0.1"},
 	}
 
+	expectConfiguration(t, firstConfiguration(t, config), []string{"127.0.0.1/32", "192.0.2.123/32", "192.168.0.24/32"})
+
+	// Only this sub-test depends on an IPv6 loopback, which many containers lack.
+	t.Run("ipv6", func(t *testing.T) {
+		mockServerv6 := newIPv6Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("1234:1234:1234:1234:1234:1234:1234:1234")) // Mock response with a sample IP address
+		}))
+
+		config.IPv6Resolver = mockServerv6.URL
+		config.WhitelistIPv6 = true
+
+		expectConfiguration(t, firstConfiguration(t, config),
+			[]string{"127.0.0.1/32", "192.0.2.123/32", "192.168.0.24/32", "1234:1234:1234:1234::/64"})
+	})
+}
+
+// firstConfiguration starts a provider with config and returns the first configuration it publishes.
+func firstConfiguration(t *testing.T, config *traefik_dynamic_public_whitelist.Config) json.Marshaler {
+	t.Helper()
+
 	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
 	if err != nil {
 		t.Fatal(err)
@@ -61,7 +83,12 @@ func TestNew(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	data := <-cfgChan
+	return <-cfgChan
+}
+
+// expectConfiguration compares data to the configuration of TestNew with sourceRange.
+func expectConfiguration(t *testing.T, data json.Marshaler, sourceRange []string) {
+	t.Helper()
 
 	expected := &dynamic.Configuration{
 		HTTP: &dynamic.HTTPConfiguration{
@@ -70,7 +97,7 @@ func TestNew(t *testing.T) {
 			Middlewares: map[string]*dynamic.Middleware{
 				"public_ipwhitelist": {
 					IPWhiteList: &dynamic.IPWhiteList{
-						SourceRange: []string{"127.0.0.1/32", "192.168.0.24", "192.0.2.123", "1234:1234:1234:1234::/64"},
+						SourceRange: sourceRange,
 						IPStrategy: &dynamic.IPStrategy{
 							Depth:       1,
 							ExcludedIPs: []string{"123.0.0.1"},
@@ -109,6 +136,667 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestPollsDoNotLeakStaleEntries(t *testing.T) {
+	var v4Requests, v6Requests int32
+
+	// Every request is answered with a new IP address, like a connection that is reassigned on every poll.
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "198.51.100.%d", atomic.AddInt32(&v4Requests, 1))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	mockServerv6 := newIPv6Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "2001:db8:%x::1", atomic.AddInt32(&v6Requests, 1))
+	}))
+
+	// Spare capacity makes an append to the configured slice write into its backing array.
+	additionalSourceRange := make([]string, 1, 16)
+	additionalSourceRange[0] = "127.0.0.1/32"
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.PollInterval = "1ms"
+	config.IPv4Resolver = mockServerv4.URL
+	config.IPv6Resolver = mockServerv6.URL
+	config.WhitelistIPv6 = true
+	config.AdditionalSourceRange = additionalSourceRange
+
+	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to the configuration after New must not reach the provider.
+	config.AdditionalSourceRange[0] = "10.0.0.0/8"
+
+	t.Cleanup(func() {
+		err = provider.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	err = provider.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgChan := make(chan json.Marshaler)
+
+	err = provider.Provide(cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for poll := 1; poll <= 100; poll++ {
+		data, err := json.Marshal(<-cfgChan)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var configuration dynamic.Configuration
+		if err = json.Unmarshal(data, &configuration); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"127.0.0.1/32", fmt.Sprintf("198.51.100.%d/32", poll), fmt.Sprintf("2001:db8:%x::/64", poll)}
+		sourceRange := configuration.HTTP.Middlewares["public_ipwhitelist"].IPWhiteList.SourceRange
+
+		if !reflect.DeepEqual(sourceRange, expected) {
+			t.Fatalf("poll %d: got %v, want %v", poll, sourceRange, expected)
+		}
+	}
+
+	for i, entry := range additionalSourceRange[1:cap(additionalSourceRange)] {
+		if entry != "" {
+			t.Errorf("backing array of the configured source range was modified at index %d: %q", i+1, entry)
+		}
+	}
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	var requests int32
+
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "198.51.100.%d", atomic.AddInt32(&requests, 1))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.PollInterval = "1h"
+	config.IPv4Resolver = mockServerv4.URL
+	config.AdminAddress = freeAddress(t)
+	config.MinRefreshInterval = "1h"
+
+	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		err = provider.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfgChan := make(chan json.Marshaler)
+
+	err = provider.Provide(cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-cfgChan
+
+	refreshURL := "http://" + config.AdminAddress + "/refresh"
+
+	resp, err := http.Get(refreshURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Post(refreshURL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+
+	select {
+	case data := <-cfgChan:
+		dataJSON, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Contains(dataJSON, []byte(`"198.51.100.2/32"`)) {
+			t.Errorf("refreshed configuration does not contain the new IP: %s", dataJSON)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("no configuration was sent after the refresh")
+	}
+
+	resp, err = http.Post(refreshURL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestProtectedRoutes(t *testing.T) {
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.123"))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.IPv4Resolver = mockServerv4.URL
+	config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{
+		"admin": {
+			Rule:           "Host(`admin.example.com`)",
+			EntryPoints:    []string{"websecure"},
+			Servers:        []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080"},
+			PassHostHeader: boolPtr(false),
+			TLS:            &dynamic.RouterTLSConfig{CertResolver: "letsencrypt"},
+		},
+		"dashboard": {
+			Rule:     "Host(`traefik.example.com`)",
+			Priority: 10,
+			Service:  "api@internal",
+		},
+	}
+
+	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		err = provider.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfgChan := make(chan json.Marshaler)
+
+	err = provider.Provide(cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(<-cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configuration dynamic.Configuration
+	if err = json.Unmarshal(data, &configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRouters := map[string]*dynamic.Router{
+		"admin": {
+			EntryPoints: []string{"websecure"},
+			Middlewares: []string{"public_ipwhitelist"},
+			Service:     "admin",
+			Rule:        "Host(`admin.example.com`)",
+			TLS:         &dynamic.RouterTLSConfig{CertResolver: "letsencrypt"},
+		},
+		"dashboard": {
+			Middlewares: []string{"public_ipwhitelist"},
+			Service:     "api@internal",
+			Rule:        "Host(`traefik.example.com`)",
+			Priority:    10,
+		},
+	}
+
+	if !reflect.DeepEqual(configuration.HTTP.Routers, expectedRouters) {
+		t.Errorf("got routers %s", data)
+	}
+
+	expectedServices := map[string]*dynamic.Service{
+		"admin": {
+			LoadBalancer: &dynamic.ServersLoadBalancer{
+				Servers:        []dynamic.Server{{URL: "http://10.0.0.2:8080"}, {URL: "http://10.0.0.3:8080"}},
+				PassHostHeader: boolPtr(false),
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(configuration.HTTP.Services, expectedServices) {
+		t.Errorf("got services %s", data)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.123"))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.IPv4Resolver = mockServerv4.URL
+	config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{
+		RateLimit: &dynamic.RateLimit{Average: 10, Burst: 20},
+		BasicAuth: &dynamic.BasicAuth{Users: dynamic.Users{"admin:$apr1$H6uskkkW$IgXLP6ewTrSuBkTrqE8wj/"}},
+	}
+	config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{
+		"admin": {Rule: "Host(`admin.example.com`)", Service: "admin@file"},
+	}
+
+	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		err = provider.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfgChan := make(chan json.Marshaler)
+
+	err = provider.Provide(cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(<-cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configuration dynamic.Configuration
+	if err = json.Unmarshal(data, &configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	middlewares := configuration.HTTP.Middlewares
+
+	chain := middlewares["public_protected"]
+	if chain == nil || chain.Chain == nil {
+		t.Fatalf("missing chain middleware: %s", data)
+	}
+
+	expectedChain := []string{"public_ipwhitelist", "public_protected-ratelimit", "public_protected-basicauth"}
+	if !reflect.DeepEqual(chain.Chain.Middlewares, expectedChain) {
+		t.Errorf("got chain %v, want %v", chain.Chain.Middlewares, expectedChain)
+	}
+
+	if rateLimit := middlewares["public_protected-ratelimit"]; rateLimit == nil || !reflect.DeepEqual(rateLimit.RateLimit, config.Chain.RateLimit) {
+		t.Errorf("unexpected rate limit middleware: %s", data)
+	}
+
+	if basicAuth := middlewares["public_protected-basicauth"]; basicAuth == nil || !reflect.DeepEqual(basicAuth.BasicAuth, config.Chain.BasicAuth) {
+		t.Errorf("unexpected basic auth middleware: %s", data)
+	}
+
+	if middlewares["public_ipwhitelist"] == nil {
+		t.Errorf("missing whitelist middleware: %s", data)
+	}
+
+	if router := configuration.HTTP.Routers["admin"]; router == nil || !reflect.DeepEqual(router.Middlewares, []string{"public_protected"}) {
+		t.Errorf("route is not protected by the chain: %s", data)
+	}
+}
+
+func TestChainAuthFallback(t *testing.T) {
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.123"))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.IPv4Resolver = mockServerv4.URL
+	config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{
+		RateLimit:    &dynamic.RateLimit{Average: 10, Burst: 20},
+		BasicAuth:    &dynamic.BasicAuth{Users: dynamic.Users{"admin:$apr1$H6uskkkW$IgXLP6ewTrSuBkTrqE8wj/"}},
+		AuthFallback: true,
+	}
+	config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{
+		"admin": {Rule: "Host(`admin.example.com`)", Service: "admin@file", Priority: 10},
+	}
+
+	data, err := json.Marshal(firstConfiguration(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configuration dynamic.Configuration
+	if err = json.Unmarshal(data, &configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	middlewares := configuration.HTTP.Middlewares
+
+	// The whitelisted IP skips basic auth, everyone else has to authenticate, and all are rate limited.
+	for name, expected := range map[string][]string{
+		"public_protected":               {"public_ipwhitelist", "public_protected-ratelimit", "public_protected-basicauth"},
+		"public_protected-whitelisted":   {"public_ipwhitelist", "public_protected-ratelimit"},
+		"public_protected-authenticated": {"public_protected-ratelimit", "public_protected-basicauth"},
+	} {
+		if chain := middlewares[name]; chain == nil || chain.Chain == nil || !reflect.DeepEqual(chain.Chain.Middlewares, expected) {
+			t.Errorf("%s: unexpected chain in %s", name, data)
+		}
+	}
+
+	routers := configuration.HTTP.Routers
+
+	if router := routers["admin"]; router == nil || router.Rule != "Host(`admin.example.com`)" || router.Priority != 10 ||
+		!reflect.DeepEqual(router.Middlewares, []string{"public_protected-authenticated"}) {
+		t.Errorf("unexpected authenticated router: %s", data)
+	}
+
+	if router := routers["admin-whitelisted"]; router == nil ||
+		router.Rule != "(Host(`admin.example.com`)) && (ClientIP(`192.0.2.123/32`))" || router.Priority != 11 ||
+		!reflect.DeepEqual(router.Middlewares, []string{"public_protected-whitelisted"}) {
+		t.Errorf("unexpected whitelisted router: %s", data)
+	}
+}
+
+func TestChainAuthFallbackLimit(t *testing.T) {
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.123"))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.IPv4Resolver = mockServerv4.URL
+	config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{
+		BasicAuth:    &dynamic.BasicAuth{Users: dynamic.Users{"admin:$apr1$H6uskkkW$IgXLP6ewTrSuBkTrqE8wj/"}},
+		AuthFallback: true,
+	}
+	config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{
+		"admin": {Rule: "Host(`admin.example.com`)", Service: "admin@file"},
+	}
+
+	for i := 0; i < 100; i++ {
+		config.AdditionalSourceRange = append(config.AdditionalSourceRange, fmt.Sprintf("10.%d.0.0/24", i))
+	}
+
+	// Too many networks for the rule of the whitelisted router, so everyone has to authenticate.
+	configuration := firstConfiguration(t, config).(*dynamic.JSONPayload).Configuration
+
+	if _, ok := configuration.HTTP.Routers["admin-whitelisted"]; ok {
+		t.Error("unexpected whitelisted router for 101 networks")
+	}
+
+	if router := configuration.HTTP.Routers["admin"]; router == nil || !reflect.DeepEqual(router.Middlewares, []string{"public_protected-authenticated"}) {
+		t.Errorf("unexpected authenticated router %+v", router)
+	}
+}
+
+func TestChainValidation(t *testing.T) {
+	basicAuth := &dynamic.BasicAuth{Users: dynamic.Users{"admin:$apr1$H6uskkkW$IgXLP6ewTrSuBkTrqE8wj/"}}
+
+	testCases := map[string]func(config *traefik_dynamic_public_whitelist.Config){
+		"fallback without auth": func(config *traefik_dynamic_public_whitelist.Config) {
+			config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{
+				RateLimit:    &dynamic.RateLimit{Average: 10},
+				AuthFallback: true,
+			}
+		},
+		"fallback with ipStrategy": func(config *traefik_dynamic_public_whitelist.Config) {
+			config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{BasicAuth: basicAuth, AuthFallback: true}
+			config.IPStrategy.Depth = 1
+		},
+		"fallback router collision": func(config *traefik_dynamic_public_whitelist.Config) {
+			config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{BasicAuth: basicAuth, AuthFallback: true}
+			config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{
+				"admin":             {Rule: "Host(`admin.example.com`)", Service: "admin@file"},
+				"admin-whitelisted": {Rule: "Host(`other.example.com`)", Service: "other@file"},
+			}
+		},
+		"fallback with countries": func(config *traefik_dynamic_public_whitelist.Config) {
+			config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{BasicAuth: basicAuth, AuthFallback: true}
+			config.Countries = []string{"DE"}
+			config.GeoIPDatabase = "/nonexistent.mmdb"
+		},
+		"part named like a whitelist": func(config *traefik_dynamic_public_whitelist.Config) {
+			config.Chain = &traefik_dynamic_public_whitelist.ChainConfig{BasicAuth: basicAuth}
+			config.Whitelists = map[string]traefik_dynamic_public_whitelist.WhitelistConfig{
+				"public_protected-basicauth": {AdditionalSourceRange: []string{"10.8.0.0/24"}},
+			}
+		},
+	}
+
+	for desc, modify := range testCases {
+		config := traefik_dynamic_public_whitelist.CreateConfig()
+		modify(config)
+
+		if _, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test"); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
+
+func TestProtectedRoutesValidation(t *testing.T) {
+	testCases := map[string]traefik_dynamic_public_whitelist.RouteConfig{
+		"missing rule":       {Servers: []string{"http://10.0.0.2"}},
+		"missing backend":    {Rule: "Host(`example.com`)"},
+		"server and service": {Rule: "Host(`example.com`)", Servers: []string{"http://10.0.0.2"}, Service: "api@internal"},
+		"invalid server":     {Rule: "Host(`example.com`)", Servers: []string{"10.0.0.2:8080"}},
+	}
+
+	for desc, route := range testCases {
+		config := traefik_dynamic_public_whitelist.CreateConfig()
+		config.Routes = map[string]traefik_dynamic_public_whitelist.RouteConfig{"test": route}
+
+		if _, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test"); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
+
+func TestTemporaryGrants(t *testing.T) {
+	mockServerv4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.123"))
+	}))
+	t.Cleanup(mockServerv4.Close)
+
+	grantsFile := filepath.Join(t.TempDir(), "grants.json")
+	grants := fmt.Sprintf(`[
+		{"sourceRange": "203.0.113.0/24", "expires": %q},
+		{"sourceRange": "203.0.113.99", "middleware": "vpn", "expires": "2001-01-01T00:00:00Z"}
+	]`, time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	if err := os.WriteFile(grantsFile, []byte(grants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := traefik_dynamic_public_whitelist.CreateConfig()
+	config.BogonPolicy = "allow"
+	config.PollInterval = "1h"
+	config.IPv4Resolver = mockServerv4.URL
+	config.AdminAddress = freeAddress(t)
+	config.GrantsFile = grantsFile
+	config.Whitelists = map[string]traefik_dynamic_public_whitelist.WhitelistConfig{
+		"vpn": {AdditionalSourceRange: []string{"10.8.0.0/24"}},
+	}
+
+	provider, err := traefik_dynamic_public_whitelist.New(context.Background(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		err = provider.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfgChan := make(chan json.Marshaler)
+
+	err = provider.Provide(cfgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSourceRanges(t, readConfiguration(t, cfgChan), map[string][]string{
+		"public_ipwhitelist": {"192.0.2.123/32", "203.0.113.0/24"},
+		"vpn":                {"10.8.0.0/24", "192.0.2.123/32"},
+	})
+
+	grantsURL := "http://" + config.AdminAddress + "/grants"
+
+	resp, err := http.Post(grantsURL, "application/json", strings.NewReader(`{"sourceRange": "198.51.100.7", "middleware": "vpn", "duration": "500ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	expectSourceRanges(t, readConfiguration(t, cfgChan), map[string][]string{
+		"public_ipwhitelist": {"192.0.2.123/32", "203.0.113.0/24"},
+		"vpn":                {"10.8.0.0/24", "192.0.2.123/32", "198.51.100.7/32"},
+	})
+
+	resp, err = http.Get("http://" + config.AdminAddress + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st struct {
+		Grants []struct {
+			SourceRange string `json:"sourceRange"`
+			Origin      string `json:"origin"`
+		} `json:"grants"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(st.Grants) != 2 || st.Grants[0].SourceRange != "198.51.100.7" || st.Grants[0].Origin != "api" || st.Grants[1].Origin != "file" {
+		t.Errorf("unexpected grants in status: %+v", st.Grants)
+	}
+
+	// The grant expires without any further request.
+	expectSourceRanges(t, readConfiguration(t, cfgChan), map[string][]string{
+		"public_ipwhitelist": {"192.0.2.123/32", "203.0.113.0/24"},
+		"vpn":                {"10.8.0.0/24", "192.0.2.123/32"},
+	})
+
+	for _, body := range []string{
+		`{"sourceRange": "198.51.100.7", "middleware": "unknown", "duration": "1h"}`,
+		`{"sourceRange": "not-an-ip", "duration": "1h"}`,
+		`{"sourceRange": "198.51.100.7", "duration": "-1h"}`,
+	} {
+		resp, err = http.Post(grantsURL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func readConfiguration(t *testing.T, cfgChan <-chan json.Marshaler) *dynamic.Configuration {
+	t.Helper()
+
+	select {
+	case data := <-cfgChan:
+		dataJSON, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		configuration := &dynamic.Configuration{}
+		if err = json.Unmarshal(dataJSON, configuration); err != nil {
+			t.Fatal(err)
+		}
+
+		return configuration
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("no configuration was sent")
+		return nil
+	}
+}
+
+func expectSourceRanges(t *testing.T, configuration *dynamic.Configuration, expected map[string][]string) {
+	t.Helper()
+
+	for name, sourceRange := range expected {
+		middleware := configuration.HTTP.Middlewares[name]
+		if middleware == nil || middleware.IPWhiteList == nil {
+			t.Errorf("missing whitelist middleware %s", name)
+			continue
+		}
+
+		if !reflect.DeepEqual(middleware.IPWhiteList.SourceRange, sourceRange) {
+			t.Errorf("%s: got %v, want %v", name, middleware.IPWhiteList.SourceRange, sourceRange)
+		}
+	}
+}
+
+// newIPv6Server starts a test server on the IPv6 loopback address, as IPv6 resolvers only connect over IPv6.
+func newIPv6Server(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// freeAddress returns a local address that is free to listen on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
 func boolPtr(v bool) *bool {
 	return &v
 }
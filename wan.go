@@ -0,0 +1,181 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// defaultWAN is the name of the only WAN, if no WANs are configured.
+const defaultWAN = ""
+
+// WANConfig an uplink of a multi-WAN setup.
+// Its public IPs are resolved through connections from one of its local addresses,
+// so policy routing sends them over this uplink.
+type WANConfig struct {
+	SourceAddresses []string `json:"sourceAddresses,omitempty"`
+	Interface       string   `json:"interface,omitempty"`
+	IPv4Resolver    string   `json:"ipv4Resolver,omitempty"`
+	IPv6Resolver    string   `json:"ipv6Resolver,omitempty"`
+}
+
+// wan an uplink whose public IPs are whitelisted.
+type wan struct {
+	name         string
+	ipv4Resolver resolver
+	ipv6Resolver resolver
+}
+
+// wanHealth is the outcome of the last resolution of a WAN.
+type wanHealth struct {
+	LastSuccess time.Time `json:"lastSuccess"`
+	Errors      []string  `json:"errors,omitempty"`
+	CGNAT       bool      `json:"cgnat,omitempty"`
+}
+
+// wanAddresses are the public IPs of every WAN, by WAN name.
+type wanAddresses map[string]IPAddresses
+
+// newWANs returns the WANs sorted by name, or the default WAN resolving through the default route.
+func newWANs(config *Config) ([]wan, error) {
+	if len(config.WANs) == 0 {
+		return []wan{{
+			name:         defaultWAN,
+			ipv4Resolver: newHTTPResolver(config.IPv4Resolver, "tcp4", nil),
+			ipv6Resolver: newHTTPResolver(config.IPv6Resolver, "tcp6", nil),
+		}}, nil
+	}
+
+	names := make([]string, 0, len(config.WANs))
+	for name := range config.WANs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	wans := make([]wan, 0, len(names))
+
+	for _, name := range names {
+		w, err := newWAN(name, config.WANs[name], config)
+		if err != nil {
+			return nil, fmt.Errorf("WAN %q: %w", name, err)
+		}
+
+		wans = append(wans, w)
+	}
+
+	return wans, nil
+}
+
+func newWAN(name string, wanConfig WANConfig, config *Config) (wan, error) {
+	if name == defaultWAN {
+		return wan{}, fmt.Errorf("invalid name")
+	}
+
+	if len(wanConfig.SourceAddresses) > 0 && wanConfig.Interface != "" {
+		return wan{}, fmt.Errorf("source addresses and interface are mutually exclusive")
+	}
+
+	if len(wanConfig.SourceAddresses) == 0 && wanConfig.Interface == "" {
+		return wan{}, fmt.Errorf("source addresses or an interface are required")
+	}
+
+	var sourceIPv4, sourceIPv6 net.IP
+
+	for _, address := range wanConfig.SourceAddresses {
+		ip := net.ParseIP(address)
+
+		switch {
+		case ip == nil:
+			return wan{}, fmt.Errorf("invalid source address %q", address)
+		case ip.To4() != nil && sourceIPv4 == nil:
+			sourceIPv4 = ip
+		case ip.To4() == nil && sourceIPv6 == nil:
+			sourceIPv6 = ip
+		default:
+			return wan{}, fmt.Errorf("more than one source address per family")
+		}
+	}
+
+	ipv4Resolver, ipv6Resolver := wanConfig.IPv4Resolver, wanConfig.IPv6Resolver
+	if ipv4Resolver == "" {
+		ipv4Resolver = config.IPv4Resolver
+	}
+
+	if ipv6Resolver == "" {
+		ipv6Resolver = config.IPv6Resolver
+	}
+
+	return wan{
+		name:         name,
+		ipv4Resolver: newHTTPResolver(ipv4Resolver, "tcp4", sourceAddress(sourceIPv4, wanConfig.Interface, false)),
+		ipv6Resolver: newHTTPResolver(ipv6Resolver, "tcp6", sourceAddress(sourceIPv6, wanConfig.Interface, true)),
+	}, nil
+}
+
+// sourceAddress returns the function looking up the local address a resolver of a family connects from:
+// the configured address, or the current address of the interface.
+// Without either for the family, the connection fails instead of silently leaving through another uplink.
+func sourceAddress(address net.IP, iface string, ipv6 bool) func() (net.IP, error) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
+	if iface == "" {
+		return func() (net.IP, error) {
+			if address == nil {
+				return nil, fmt.Errorf("no %s source address", family)
+			}
+
+			return address, nil
+		}
+	}
+
+	return func() (net.IP, error) {
+		return interfaceAddress(iface, ipv6)
+	}
+}
+
+// interfaceAddress returns the first global unicast address of a family of the interface.
+// It's looked up on every connection, as the address of an uplink may change at any time.
+func interfaceAddress(name string, ipv6 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+
+		return ipNet.IP, nil
+	}
+
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
+	return nil, fmt.Errorf("interface %s has no %s address", name, family)
+}
+
+// setWANHealth records the outcome of a resolution of a WAN.
+func (p *Provider) setWANHealth(name string, health wanHealth) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+
+	if health.LastSuccess.IsZero() {
+		health.LastSuccess = p.wanHealth[name].LastSuccess
+	}
+
+	p.wanHealth[name] = health
+}
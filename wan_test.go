@@ -0,0 +1,217 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewWANsValidation(t *testing.T) {
+	testCases := map[string]map[string]WANConfig{
+		"empty name":            {"": {SourceAddresses: []string{"192.0.2.1"}}},
+		"no source":             {"a": {}},
+		"source and interface":  {"a": {SourceAddresses: []string{"192.0.2.1"}, Interface: "eth0"}},
+		"invalid address":       {"a": {SourceAddresses: []string{"192.0.2.300"}}},
+		"two addresses of IPv4": {"a": {SourceAddresses: []string{"192.0.2.1", "192.0.2.2"}}},
+	}
+
+	for desc, wans := range testCases {
+		config := CreateConfig()
+		config.WANs = wans
+
+		if _, err := newWANs(config); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+
+	config := CreateConfig()
+	config.WANs = map[string]WANConfig{
+		"b": {Interface: "eth1", IPv4Resolver: "https://example.com/ip"},
+		"a": {SourceAddresses: []string{"192.0.2.1", "2001:db8::1"}},
+	}
+
+	wans, err := newWANs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wans) != 2 || wans[0].name != "a" || wans[1].name != "b" {
+		t.Fatalf("unexpected WANs %+v", wans)
+	}
+
+	if url := wans[1].ipv4Resolver.(httpResolver).url; url != "https://example.com/ip" {
+		t.Errorf("got IPv4 resolver %s", url)
+	}
+
+	if url := wans[1].ipv6Resolver.(httpResolver).url; url != config.IPv6Resolver {
+		t.Errorf("got IPv6 resolver %s", url)
+	}
+}
+
+func TestResolverSourceAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprint(w, host)
+	}))
+	t.Cleanup(server.Close)
+
+	// Every address of 127.0.0.0/8 is local, so the connection can be made from another one than 127.0.0.1.
+	source := sourceAddress(net.ParseIP("127.0.0.2"), "", false)
+
+	ip, err := newHTTPResolver(server.URL, "tcp4", source).resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip != "127.0.0.2" {
+		t.Errorf("got %s, want 127.0.0.2", ip)
+	}
+
+	// Without a source address for the family, no connection is made.
+	if _, err = newHTTPResolver(server.URL, "tcp4", sourceAddress(nil, "", false)).resolve(context.Background()); err == nil {
+		t.Error("expected an error without a source address")
+	}
+}
+
+func TestInterfaceAddress(t *testing.T) {
+	if _, err := interfaceAddress("does-not-exist0", false); err == nil {
+		t.Error("expected an error for an unknown interface")
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		// Loopback addresses are no global unicast addresses.
+		if ip, err := interfaceAddress(iface.Name, false); err == nil {
+			t.Errorf("%s: got %s", iface.Name, ip)
+		}
+	}
+}
+
+func TestMultiWAN(t *testing.T) {
+	config := testConfig()
+	config.WANs = map[string]WANConfig{
+		"fiber": {SourceAddresses: []string{"10.0.1.2"}},
+		"lte":   {SourceAddresses: []string{"10.0.2.2"}},
+	}
+
+	clock := newFakeClock()
+	fiber := &fakeResolver{answers: []fakeAnswer{{ip: "198.51.100.1"}}}
+	lte := &fakeResolver{answers: []fakeAnswer{{ip: "203.0.113.1"}, {err: errResolver}}}
+
+	p, cfgChan := startProvider(t, config, withClock(clock),
+		withWANResolvers("fiber", fiber, fiber), withWANResolvers("lte", lte, lte))
+
+	want := []string{"198.51.100.1/32", "203.0.113.1/32"}
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	clock.Advance(300 * time.Second)
+
+	// The failing WAN keeps its last address and doesn't affect the other one.
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	p.statusMu.Lock()
+	st := p.status
+	p.statusMu.Unlock()
+
+	if st.WANs["fiber"].IPv4 != "198.51.100.1" || len(st.WANs["fiber"].Errors) != 0 {
+		t.Errorf("unexpected status of fiber %+v", st.WANs["fiber"])
+	}
+
+	if st.WANs["lte"].IPv4 != "203.0.113.1" || len(st.WANs["lte"].Errors) != 1 || st.WANs["lte"].LastSuccess.IsZero() {
+		t.Errorf("unexpected status of lte %+v", st.WANs["lte"])
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	config := testConfig()
+	config.WANs = map[string]WANConfig{
+		"fiber": {SourceAddresses: []string{"10.0.1.2"}},
+		"lte":   {SourceAddresses: []string{"10.0.2.2"}},
+	}
+
+	fiber := &fakeResolver{answers: []fakeAnswer{{ip: "198.51.100.1"}}}
+	lte := &blockingResolver{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(lte.release)
+
+	p, err := newProvider(context.Background(), config, "test", withClock(newFakeClock()),
+		withWANResolvers("fiber", fiber, fiber), withWANResolvers("lte", lte, lte))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.resolveTimeout = 10 * time.Millisecond
+
+	cfgChan := make(chan json.Marshaler, 1)
+
+	if err = p.Provide(cfgChan); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := p.Stop(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The hanging WAN fails, the other one is published anyway.
+	if got, want := nextSourceRange(t, cfgChan), []string{"198.51.100.1/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHangingWANDoesNotHoldBackGrantExpiry(t *testing.T) {
+	config := testConfig()
+	config.WANs = map[string]WANConfig{
+		"fiber": {SourceAddresses: []string{"10.0.1.2"}},
+		"lte":   {SourceAddresses: []string{"10.0.2.2"}},
+	}
+
+	clock := newFakeClock()
+	fiber := &fakeResolver{answers: []fakeAnswer{{ip: "198.51.100.1"}}}
+	lte := &blockingResolver{started: make(chan struct{}, 1), release: make(chan struct{}), free: 1}
+	defer close(lte.release)
+
+	p, cfgChan := startProvider(t, config, withClock(clock),
+		withWANResolvers("fiber", fiber, fiber), withWANResolvers("lte", lte, lte))
+
+	want := []string{"192.0.2.1/32", "198.51.100.1/32"}
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	p.grants.add(grant{SourceRange: "203.0.113.7/32", Middleware: whitelistMiddleware, Expires: clock.Now().Add(10 * time.Minute)})
+	notify(p.regenerate)
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, []string{"192.0.2.1/32", "198.51.100.1/32", "203.0.113.7/32"}) {
+		t.Errorf("with the grant: got %v", got)
+	}
+
+	// The next poll hangs on lte.
+	clock.Advance(5 * time.Minute)
+	<-lte.started
+
+	// The grant expires anyway, the whitelist keeps the last addresses.
+	clock.Advance(5 * time.Minute)
+
+	if got := nextSourceRange(t, cfgChan); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the expiry: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package traefik_dynamic_public_whitelist
+
+import (
+	"fmt"
+	"sort"
+)
+
+// WhitelistConfig an additional whitelist middleware.
+// Like public_ipwhitelist it accepts the public IPs, but it has its own additional and excluded source ranges.
+type WhitelistConfig struct {
+	AdditionalSourceRange []string `json:"additionalSourceRange,omitempty"`
+	ExcludedSourceRange   []string `json:"excludedSourceRange,omitempty"`
+	Countries             []string `json:"countries,omitempty"`
+}
+
+// whitelist the settings of a generated IPWhiteList middleware.
+type whitelist struct {
+	name                  string
+	additionalSourceRange []string
+	excludedSourceRange   []string
+	countries             []string
+}
+
+// newWhitelists returns the settings of public_ipwhitelist followed by the additional whitelists, sorted by name.
+// The global excluded source range applies to all of them.
+func newWhitelists(config *Config) ([]whitelist, error) {
+	if _, err := parseIPRanges(config.AdditionalSourceRange); err != nil {
+		return nil, fmt.Errorf("additional source range: %w", err)
+	}
+
+	if _, err := parseIPRanges(config.ExcludedSourceRange); err != nil {
+		return nil, fmt.Errorf("excluded source range: %w", err)
+	}
+
+	countries, err := normalizeCountries(config.Countries)
+	if err != nil {
+		return nil, err
+	}
+
+	whitelists := []whitelist{{
+		name:                  whitelistMiddleware,
+		additionalSourceRange: copyStrings(config.AdditionalSourceRange),
+		excludedSourceRange:   copyStrings(config.ExcludedSourceRange),
+		countries:             countries,
+	}}
+
+	names := make([]string, 0, len(config.Whitelists))
+	for name := range config.Whitelists {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		wl := config.Whitelists[name]
+
+		if name == "" || name == whitelistMiddleware {
+			return nil, fmt.Errorf("whitelist %q: invalid name", name)
+		}
+
+		if _, err := parseIPRanges(wl.AdditionalSourceRange); err != nil {
+			return nil, fmt.Errorf("whitelist %q: additional source range: %w", name, err)
+		}
+
+		if _, err := parseIPRanges(wl.ExcludedSourceRange); err != nil {
+			return nil, fmt.Errorf("whitelist %q: excluded source range: %w", name, err)
+		}
+
+		countries, err := normalizeCountries(wl.Countries)
+		if err != nil {
+			return nil, fmt.Errorf("whitelist %q: %w", name, err)
+		}
+
+		excluded := make([]string, 0, len(config.ExcludedSourceRange)+len(wl.ExcludedSourceRange))
+		excluded = append(excluded, config.ExcludedSourceRange...)
+		excluded = append(excluded, wl.ExcludedSourceRange...)
+
+		whitelists = append(whitelists, whitelist{
+			name:                  name,
+			additionalSourceRange: copyStrings(wl.AdditionalSourceRange),
+			excludedSourceRange:   excluded,
+			countries:             countries,
+		})
+	}
+
+	return whitelists, nil
+}
+
+// hasWhitelist reports whether the provider generates a whitelist middleware called name.
+func (p *Provider) hasWhitelist(name string) bool {
+	return containsWhitelist(p.whitelists, name)
+}
+
+func containsWhitelist(whitelists []whitelist, name string) bool {
+	for _, wl := range whitelists {
+		if wl.name == name {
+			return true
+		}
+	}
+
+	return false
+}